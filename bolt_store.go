@@ -0,0 +1,274 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"time"
+
+	bolt "github.com/boltdb/bolt"
+)
+
+var (
+	boltBuildsBucket = []byte("builds")
+	boltOrderBucket  = []byte("order")
+	boltLogsBucket   = []byte("logs")
+	boltMetaBucket   = []byte("meta")
+	boltFrameworkId  = []byte("framework_id")
+)
+
+// BoltStore keeps builds and logs in an embedded database file, so a single
+// Gladius can run without a Redis server. The builds bucket maps ids to JSON,
+// the order bucket maps a creation sequence to ids, and the logs bucket holds
+// a bucket per log mapping a sequence to each line. The meta bucket holds the
+// framework's id.
+type BoltStore struct {
+	db          *bolt.DB
+	broadcaster *logBroadcaster
+}
+
+func NewBoltStore(path string) (*BoltStore, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 1 * time.Second})
+
+	if err != nil {
+		return nil, err
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{boltBuildsBucket, boltOrderBucket, boltLogsBucket, boltMetaBucket} {
+			_, err := tx.CreateBucketIfNotExists(name)
+
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		db.Close()
+
+		return nil, err
+	}
+
+	return &BoltStore{
+		db:          db,
+		broadcaster: newLogBroadcaster(),
+	}, nil
+}
+
+func boltSequenceKey(sequence uint64) []byte {
+	key := make([]byte, 8)
+
+	binary.BigEndian.PutUint64(key, sequence)
+
+	return key
+}
+
+func (s *BoltStore) CreateBuild(b *Build) error {
+	buildJson, err := json.Marshal(b)
+
+	if err != nil {
+		return err
+	}
+
+	return s.db.Update(func(tx *bolt.Tx) error {
+		order := tx.Bucket(boltOrderBucket)
+		sequence, err := order.NextSequence()
+
+		if err != nil {
+			return err
+		}
+
+		err = order.Put(boltSequenceKey(sequence), []byte(b.Id))
+
+		if err != nil {
+			return err
+		}
+
+		return tx.Bucket(boltBuildsBucket).Put([]byte(b.Id), buildJson)
+	})
+}
+
+func (s *BoltStore) SaveBuild(b *Build) error {
+	buildJson, err := json.Marshal(b)
+
+	if err != nil {
+		return err
+	}
+
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltBuildsBucket).Put([]byte(b.Id), buildJson)
+	})
+}
+
+func (s *BoltStore) GetBuild(id string) (*Build, error) {
+	var build *Build
+
+	err := s.db.View(func(tx *bolt.Tx) error {
+		var err error
+
+		build, err = boltGetBuild(tx, id)
+
+		return err
+	})
+
+	return build, err
+}
+
+func boltGetBuild(tx *bolt.Tx, id string) (*Build, error) {
+	var build Build
+
+	buildJson := tx.Bucket(boltBuildsBucket).Get([]byte(id))
+
+	if buildJson == nil {
+		return nil, errBuildNotFound
+	}
+
+	err := json.Unmarshal(buildJson, &build)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &build, nil
+}
+
+func (s *BoltStore) ListBuilds(limit int) ([]*Build, error) {
+	builds := []*Build{}
+
+	err := s.db.View(func(tx *bolt.Tx) error {
+		cursor := tx.Bucket(boltOrderBucket).Cursor()
+
+		for _, id := cursor.Last(); id != nil && len(builds) < limit; _, id = cursor.Prev() {
+			build, err := boltGetBuild(tx, string(id))
+
+			if err != nil {
+				return err
+			}
+
+			builds = append(builds, build)
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return builds, nil
+}
+
+func (s *BoltStore) ListUnfinishedBuilds() ([]*Build, error) {
+	builds := []*Build{}
+
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltBuildsBucket).ForEach(func(id []byte, buildJson []byte) error {
+			var build Build
+
+			err := json.Unmarshal(buildJson, &build)
+
+			if err != nil {
+				return err
+			}
+
+			if !build.State.IsTerminal() {
+				builds = append(builds, &build)
+			}
+
+			return nil
+		})
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return builds, nil
+}
+
+func (s *BoltStore) AppendLog(buildId string, taskId string, line string) error {
+	var index int
+
+	name := logName(buildId, taskId)
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		bucket, err := tx.Bucket(boltLogsBucket).CreateBucketIfNotExists([]byte(name))
+
+		if err != nil {
+			return err
+		}
+
+		sequence, err := bucket.NextSequence()
+
+		if err != nil {
+			return err
+		}
+
+		index = int(sequence) - 1
+
+		return bucket.Put(boltSequenceKey(sequence), []byte(line))
+	})
+
+	if err != nil {
+		return err
+	}
+
+	s.broadcaster.publish(name, LogLine{index, line})
+
+	return nil
+}
+
+func (s *BoltStore) ReadLog(buildId string, taskId string, start int) ([]string, error) {
+	lines := []string{}
+
+	err := s.db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(boltLogsBucket).Bucket([]byte(logName(buildId, taskId)))
+
+		if bucket == nil {
+			return nil
+		}
+
+		cursor := bucket.Cursor()
+
+		// Sequences start at one, so the line at index start is keyed
+		// by start + 1.
+		for key, line := cursor.Seek(boltSequenceKey(uint64(start) + 1)); key != nil; key, line = cursor.Next() {
+			lines = append(lines, string(line))
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return lines, nil
+}
+
+func (s *BoltStore) SubscribeLog(buildId string, taskId string, done <-chan bool) (<-chan LogLine, error) {
+	return s.broadcaster.subscribe(logName(buildId, taskId), done), nil
+}
+
+func (s *BoltStore) FrameworkId() (string, error) {
+	var id string
+
+	err := s.db.View(func(tx *bolt.Tx) error {
+		id = string(tx.Bucket(boltMetaBucket).Get(boltFrameworkId))
+
+		return nil
+	})
+
+	return id, err
+}
+
+func (s *BoltStore) SaveFrameworkId(id string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		if id == "" {
+			return tx.Bucket(boltMetaBucket).Delete(boltFrameworkId)
+		}
+
+		return tx.Bucket(boltMetaBucket).Put(boltFrameworkId, []byte(id))
+	})
+}
@@ -1,271 +1,552 @@
 package main
 
 import (
+	"archive/tar"
 	"bufio"
 	"bytes"
-	"encoding/json"
+	"context"
 	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"log"
 	"math/rand"
+	"net/http"
 	"os"
+	"path"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	docker "github.com/fsouza/go-dockerclient"
+	proto "github.com/gogo/protobuf/proto"
 	mesos "github.com/mesos/mesos-go/mesosproto"
+	util "github.com/mesos/mesos-go/mesosutil"
+)
+
+const (
+	defaultBaseImage  = "docker.corp.adobe.com/typekit/bundler-typekit"
+	checkoutDir       = "/checkout"
+	buildTimeout      = 30 * time.Minute
+	stepRetryInterval = 10 * time.Second
+	taskTimeoutCheck  = 10 * time.Second
+)
+
+var (
+	errBuildTimedOut  = errors.New("Build timed out")
+	errBuildCancelled = errors.New("Build cancelled")
+	errBuildFinished  = errors.New("Build already finished")
 )
 
 type Build struct {
 	Id               string                 `json:"id,omitempty"`
 	App              string                 `json:"app,omitempty"`
 	Branch           string                 `json:"branch,omitempty"`
+	Priority         int                    `json:"priority,omitempty"`
+	CloneContainer   *docker.Container      `json:"-"`
 	Container        *docker.Container      `json:"-"`
 	Image            *docker.Image          `json:"-"`
+	ContainerIds     []string               `json:"containerIds,omitempty"`
 	TaskStatusesChan chan *mesos.TaskStatus `json:"-"`
 	Tasks            []*Task                `json:"tasks,omitempty"`
 	BaseImage        string                 `json:"baseImage,omitempty"`
+	Manifest         *Manifest              `json:"manifest,omitempty"`
+	State            BuildState             `json:"state,omitempty"`
+	Stages           []*Stage               `json:"stages,omitempty"`
+	CreatedAt        time.Time              `json:"createdAt"`
+	Deadline         time.Time              `json:"deadline"`
+	FinishedAt       *time.Time             `json:"finishedAt,omitempty"`
 	Log              string                 `json:"log,omitempty"`
+	ctx              context.Context
+	cancel           context.CancelFunc
+	mutex            sync.Mutex
+	containerOutput  sync.WaitGroup
+}
+
+// buildStep is one stage of preparing a build's image. Its run function is
+// retried until it succeeds, times out or the whole build times out.
+type buildStep struct {
+	name     string
+	state    BuildState
+	timeout  time.Duration
+	run      func() (<-chan bool, <-chan error)
+	optional bool
+}
+
+// stepError is sent by a step when retrying it cannot succeed.
+type stepError struct {
+	error
+}
+
+type stepTimeoutError struct {
+	step string
+}
+
+func (e *stepTimeoutError) Error() string {
+	return fmt.Sprintf("Timed out %s", e.step)
 }
 
 func NewBuild() *Build {
+	now := time.Now()
+	ctx, cancel := context.WithCancel(context.Background())
+
 	return &Build{
-		Id: strconv.Itoa(rand.Int()),
-		Tasks: []*Task{
-			NewTask("rspec spec/api --no-color"),
-			NewTask("rspec spec/config --no-color"),
-			NewTask("rspec spec/controllers --no-color"),
-			NewTask("rspec spec/helpers --no-color"),
-			NewTask("rspec spec/integration --no-color"),
-			NewTask("rspec spec/lib --no-color"),
-			NewTask("rspec spec/mails --no-color"),
-			NewTask("rspec spec/models --no-color"),
-			NewTask("rspec spec/racks --no-color"),
-			NewTask("rspec spec/requests --no-color"),
-			NewTask("rspec spec/routing --no-color"),
-			NewTask("cucumber --profile=default --no-color --format=progress features/accounts"),
-			NewTask("cucumber --profile=default --no-color --format=progress features/auth"),
-			NewTask("cucumber --profile=default --no-color --format=progress features/api"),
-			NewTask("cucumber --profile=default --no-color --format=progress features/web"),
-			NewTask("cucumber --profile=default --no-color --format=progress features/ccm"),
-			NewTask("cucumber --profile=licensing --no-color --format=progress features/licensing"),
-			NewTask("cucumber --profile=mails --no-color --format=progress features/mails"),
-		},
+		Id:               strconv.Itoa(rand.Int()),
+		Tasks:            []*Task{},
 		TaskStatusesChan: make(chan *mesos.TaskStatus),
-		BaseImage:        "docker.corp.adobe.com/typekit/bundler-typekit",
+		BaseImage:        defaultBaseImage,
+		State:            BuildQueued,
+		Stages:           []*Stage{{State: BuildQueued, StartedAt: now}},
+		CreatedAt:        now,
+		ctx:              ctx,
+		cancel:           cancel,
 	}
 }
 
 func (b *Build) Build() {
-	retryInterval := 10 * time.Second
-	buildIsTakingTooLong := time.After(30 * time.Minute)
+	b.Deadline = time.Now().Add(buildTimeout)
+	buildIsTakingTooLong := time.After(buildTimeout)
+	err := b.runSteps(b.cloneSteps(), buildIsTakingTooLong)
 
-pullImageLoop:
-	for {
-		pullIsTakingTooLong := time.After(10 * time.Second)
-		pulledSuccessfully, errorWhilePulling := b.pullBaseImage()
+	if err == nil {
+		err = b.loadManifest()
 
-		select {
-		case <-pulledSuccessfully:
-			break pullImageLoop
-		case <-errorWhilePulling:
-			time.Sleep(retryInterval)
+		if err != nil {
+			b.log("Could not load manifest: %v", err)
+		}
+	}
 
-			continue pullImageLoop
-		case <-pullIsTakingTooLong:
-			b.log("Timed out pulling base image")
+	if err == nil {
+		err = b.runSteps(b.setupSteps(), buildIsTakingTooLong)
+	}
 
-			return
-		case <-buildIsTakingTooLong:
-			b.log("Build timed out")
+	if err != nil {
+		b.removeContainers()
+		b.transition(stateForError(err))
 
-			return
-		}
+		return
 	}
 
-createContainerLoop:
-	for {
-		createIsTakingTooLong := time.After(10 * time.Second)
-		createdSuccessfully, errorWhileCreating := b.createContainer()
+	b.transition(BuildTesting)
+	b.launchTasks()
 
-		select {
-		case <-createdSuccessfully:
-			break createContainerLoop
-		case err := <-errorWhileCreating:
-			b.log(err.Error())
-			time.Sleep(retryInterval)
+	// Tasks run from the pushed image unless the runner shares this Docker
+	// daemon, in which case the image is removed once they are done.
+	if !runner.NeedsPushedImage() {
+		return
+	}
 
-			continue createContainerLoop
-		case <-createIsTakingTooLong:
-			b.log("Timed out creating container")
+	b.runSteps([]*buildStep{
+		{
+			name:     "removing image",
+			state:    BuildTesting,
+			timeout:  1 * time.Minute,
+			run:      b.removeImage,
+			optional: true,
+		},
+	}, buildIsTakingTooLong)
+}
 
-			return
-		case <-buildIsTakingTooLong:
-			b.log("Build timed out")
+// cloneSteps checks out the repository into a volume of the clone container,
+// so its manifest can be read before the build image is set up.
+func (b *Build) cloneSteps() []*buildStep {
+	return []*buildStep{
+		{
+			name:    "pulling clone image",
+			state:   BuildPulling,
+			timeout: 10 * time.Minute,
+			run:     b.pullBaseImage,
+		},
+		{
+			name:    "creating clone container",
+			state:   BuildCloning,
+			timeout: 10 * time.Second,
+			run: func() (<-chan bool, <-chan error) {
+				return b.createContainer(&b.CloneContainer, b.cloneContainerOptions())
+			},
+		},
+		{
+			name:    "attaching to clone container",
+			state:   BuildCloning,
+			timeout: 10 * time.Second,
+			run: func() (<-chan bool, <-chan error) {
+				return b.containerLogs(b.CloneContainer, "clone")
+			},
+		},
+		{
+			name:    "starting clone container",
+			state:   BuildCloning,
+			timeout: 10 * time.Second,
+			run: func() (<-chan bool, <-chan error) {
+				return b.startContainer(b.CloneContainer, b.cloneHostConfig())
+			},
+		},
+		{
+			name:    "waiting for clone container",
+			state:   BuildCloning,
+			timeout: 10 * time.Minute,
+			run: func() (<-chan bool, <-chan error) {
+				return b.waitContainer(b.CloneContainer)
+			},
+		},
+	}
+}
 
-			return
-		}
+// setupSteps runs the manifest's setup command against a copy of the checkout
+// in the base image, then commits and pushes the result as the build image.
+func (b *Build) setupSteps() []*buildStep {
+	steps := []*buildStep{
+		{
+			name:    "pulling base image",
+			state:   BuildPulling,
+			timeout: 10 * time.Minute,
+			run:     b.pullBaseImage,
+		},
+		{
+			name:    "creating container",
+			state:   BuildCloning,
+			timeout: 10 * time.Second,
+			run: func() (<-chan bool, <-chan error) {
+				return b.createContainer(&b.Container, b.setupContainerOptions())
+			},
+		},
+		{
+			name:    "attaching to container",
+			state:   BuildCloning,
+			timeout: 10 * time.Second,
+			run: func() (<-chan bool, <-chan error) {
+				return b.containerLogs(b.Container, "setup")
+			},
+		},
+		{
+			name:    "starting container",
+			state:   BuildCloning,
+			timeout: 10 * time.Second,
+			run: func() (<-chan bool, <-chan error) {
+				return b.startContainer(b.Container, b.setupHostConfig())
+			},
+		},
+		{
+			name:    "waiting container",
+			state:   BuildCloning,
+			timeout: 10 * time.Minute,
+			run: func() (<-chan bool, <-chan error) {
+				return b.waitContainer(b.Container)
+			},
+		},
+		{
+			name:    "commiting container",
+			state:   BuildCommitting,
+			timeout: 1 * time.Minute,
+			run:     b.commitContainer,
+		},
+		{
+			name:    "removing container",
+			state:   BuildCommitting,
+			timeout: 1 * time.Minute,
+			run: func() (<-chan bool, <-chan error) {
+				return b.removeContainer(b.Container)
+			},
+			optional: true,
+		},
+		{
+			name:    "removing clone container",
+			state:   BuildCommitting,
+			timeout: 1 * time.Minute,
+			run: func() (<-chan bool, <-chan error) {
+				return b.removeContainer(b.CloneContainer)
+			},
+			optional: true,
+		},
 	}
 
-startContainerLoop:
-	for {
-		startIsTakingTooLong := time.After(10 * time.Second)
-		startedSuccessfully, errorWhileStarting := b.startContainer()
+	if runner.NeedsPushedImage() {
+		steps = append(steps, &buildStep{
+			name:    "pushing image",
+			state:   BuildPushing,
+			timeout: 10 * time.Minute,
+			run:     b.pushImage,
+		})
+	}
 
-		select {
-		case <-startedSuccessfully:
-			break startContainerLoop
-		case err := <-errorWhileStarting:
-			b.log(err.Error())
-			time.Sleep(retryInterval)
+	return steps
+}
 
-			continue startContainerLoop
-		case <-startIsTakingTooLong:
-			b.log("Timed out starting container")
+// stateForError returns the terminal state of a build stopped by the error.
+func stateForError(err error) BuildState {
+	if _, ok := err.(*stepTimeoutError); ok || err == errBuildTimedOut {
+		return BuildTimedOut
+	}
 
-			return
-		case <-buildIsTakingTooLong:
-			b.log("Build timed out")
+	if err == errBuildCancelled {
+		return BuildCancelled
+	}
 
-			return
-		}
+	return BuildErrored
+}
+
+// Cancel stops the build in whatever stage it is in: the image stages are
+// interrupted, queued tasks are withdrawn and launched tasks are killed.
+func (b *Build) Cancel() error {
+	if b.State.IsTerminal() {
+		return errBuildFinished
 	}
 
-waitContainerLoop:
-	for {
-		waitIsTakingTooLong := time.After(10 * time.Minute)
-		waitedSuccessfully, errorWhileWaiting := b.waitContainer()
+	b.stop()
 
-		select {
-		case <-waitedSuccessfully:
-			break waitContainerLoop
-		case <-errorWhileWaiting:
-			time.Sleep(retryInterval)
+	return b.transition(BuildCancelled)
+}
 
-			continue waitContainerLoop
-		case <-waitIsTakingTooLong:
-			b.log("Timed out waiting container")
+// stop withdraws queued tasks and kills the launched ones that are still
+// running.
+func (b *Build) stop() {
+	if b.cancel != nil {
+		b.cancel()
+	}
 
-			return
-		case <-buildIsTakingTooLong:
-			b.log("Build timed out")
+	queue.Remove(b.Id)
 
-			return
+	// Updates for a stopped build are no longer read, so its running tasks
+	// are recorded as killed rather than left running.
+	killed := []*Attempt{}
+
+	b.mutex.Lock()
+
+	for _, task := range b.Tasks {
+		attempt := task.Attempt()
+
+		if attempt == nil || attempt.LaunchedAt == nil || task.IsTerminal() {
+			continue
 		}
+
+		status := &mesos.TaskStatus{
+			TaskId:    util.NewTaskID(attempt.Id),
+			State:     mesos.TaskState_TASK_KILLED.Enum(),
+			Message:   proto.String("Killed as the build was stopped"),
+			Timestamp: proto.Float64(float64(time.Now().UnixNano()) / float64(time.Second)),
+		}
+		attempt.Status = status
+		task.Status = status
+		killed = append(killed, attempt)
 	}
 
-commitContainerLoop:
-	for {
-		commitIsTakingTooLong := time.After(1 * time.Minute)
-		commitedSuccessfully, errorWhileCommitting := b.commitContainer()
+	if len(killed) != 0 {
+		b.save()
+	}
 
-		select {
-		case <-commitedSuccessfully:
-			break commitContainerLoop
-		case <-errorWhileCommitting:
-			time.Sleep(retryInterval)
+	b.mutex.Unlock()
 
-			continue commitContainerLoop
-		case <-commitIsTakingTooLong:
-			b.log("Timed out commiting container")
+	for _, attempt := range killed {
+		b.log("Killing task %s", attempt.Id)
 
-			return
-		case <-buildIsTakingTooLong:
-			b.log("Build timed out")
+		err := runner.KillTask(attempt.Id)
 
-			return
+		if err != nil {
+			b.log("Could not kill task %s: %v", attempt.Id, err)
 		}
 	}
+}
 
-removeContainerLoop:
-	for {
-		removeIsTakingTooLong := time.After(1 * time.Minute)
-		removedSuccessfully, errorWhileRemoving := b.removeContainer()
+func (b *Build) cancelled() bool {
+	select {
+	case <-b.ctx.Done():
+		return true
+	default:
+		return false
+	}
+}
 
-		select {
-		case <-removedSuccessfully:
-			break removeContainerLoop
-		case <-errorWhileRemoving:
-			time.Sleep(retryInterval)
+// removeContainers removes every container created for the build, including
+// those created by a previous process.
+func (b *Build) removeContainers() {
+	for _, id := range b.ContainerIds {
+		opts := docker.RemoveContainerOptions{
+			ID:            id,
+			RemoveVolumes: true,
+			Force:         true,
+		}
+		err := dockerCli.RemoveContainer(opts)
 
-			continue removeContainerLoop
-		case <-removeIsTakingTooLong:
-			b.log("Timed out removing container")
+		if err != nil {
+			b.log("Error removing container %v: %v", opts, err)
+		}
+	}
+}
 
-			break removeContainerLoop
-		case <-buildIsTakingTooLong:
-			b.log("Build timed out")
+// runSteps runs each step in order, moving the build into the step's state,
+// and returns the error that stopped the build from carrying on, if any.
+func (b *Build) runSteps(steps []*buildStep, buildIsTakingTooLong <-chan time.Time) error {
+	for _, step := range steps {
+		b.transition(step.state)
 
-			return
+		err := b.runStep(step, buildIsTakingTooLong)
+
+		if err != nil {
+			return err
 		}
 	}
 
-pushImageLoop:
+	return nil
+}
+
+func (b *Build) runStep(step *buildStep, buildIsTakingTooLong <-chan time.Time) error {
 	for {
-		pushIsTakingTooLong := time.After(10 * time.Minute)
-		pushedSuccessfully, errorWhilePushing := b.pushImage()
+		stepIsTakingTooLong := time.After(step.timeout)
+		doneSuccessfully, errorWhileRunning := step.run()
 
 		select {
-		case <-pushedSuccessfully:
-			break pushImageLoop
-		case <-errorWhilePushing:
-			time.Sleep(retryInterval)
+		case <-doneSuccessfully:
+			return nil
+		case err := <-errorWhileRunning:
+			if _, ok := err.(*stepError); ok {
+				return err
+			}
 
-			continue pushImageLoop
-		case <-pushIsTakingTooLong:
-			b.log("Timed out pushing image")
+			time.Sleep(stepRetryInterval)
 
-			return
+			continue
+		case <-stepIsTakingTooLong:
+			err := &stepTimeoutError{step.name}
+
+			b.log(err.Error())
+
+			if step.optional {
+				return nil
+			}
+
+			return err
 		case <-buildIsTakingTooLong:
-			b.log("Build timed out")
+			b.log(errBuildTimedOut.Error())
 
-			return
+			return errBuildTimedOut
+		case <-b.ctx.Done():
+			return errBuildCancelled
 		}
 	}
+}
 
-	b.launchTasks()
+// loadManifest reads the manifest from the cloned repository, applies the
+// inline manifest submitted with the build on top of it and creates the
+// build's tasks from the result.
+func (b *Build) loadManifest() error {
+	var (
+		buf          bytes.Buffer
+		repoManifest *Manifest
+	)
+
+	opts := docker.DownloadFromContainerOptions{
+		Path:              b.ManifestPath(),
+		OutputStream:      &buf,
+		InactivityTimeout: 1 * time.Minute,
+		Context:           b.ctx,
+	}
 
-removeImageLoop:
-	for {
-		removeIsTakingTooLong := time.After(1 * time.Minute)
-		removedSuccessfully, errorWhileRemoving := b.removeImage()
+	b.log("Reading manifest %s", opts.Path)
 
-		select {
-		case <-removedSuccessfully:
-			break removeImageLoop
-		case <-errorWhileRemoving:
-			time.Sleep(retryInterval)
+	err := dockerCli.DownloadFromContainer(b.CloneContainer.ID, opts)
 
-			continue removeImageLoop
-		case <-removeIsTakingTooLong:
-			b.log("Timed out removing image")
+	if apiErr, ok := err.(*docker.Error); ok && apiErr.Status == http.StatusNotFound {
+		b.log("Repository has no %s", manifestFile)
+	} else if err != nil {
+		return err
+	} else {
+		archive := tar.NewReader(&buf)
+		_, err = archive.Next()
 
-			return
-		case <-buildIsTakingTooLong:
-			b.log("Build timed out")
+		if err != nil {
+			return err
+		}
 
-			return
+		data, err := ioutil.ReadAll(archive)
+
+		if err != nil {
+			return err
 		}
+
+		repoManifest, err = ParseManifest(data)
+
+		if err != nil {
+			return err
+		}
+	}
+
+	manifest := repoManifest.Merge(b.Manifest)
+	err = manifest.Validate()
+
+	if err != nil {
+		return err
 	}
+
+	b.Manifest = manifest
+	b.Tasks = manifest.NewTasks()
+
+	if manifest.BaseImage != "" {
+		b.BaseImage = manifest.BaseImage
+	}
+
+	b.log("Loaded manifest with %d tasks", len(b.Tasks))
+
+	return b.Save()
 }
 
-func (b *Build) createContainer() (<-chan bool, <-chan error) {
-	doneChan := make(chan bool)
-	errorChan := make(chan error)
-	opts := docker.CreateContainerOptions{
+func (b *Build) cloneContainerOptions() docker.CreateContainerOptions {
+	return docker.CreateContainerOptions{
 		Config: &docker.Config{
 			Tty:          true,
 			AttachStdin:  true,
 			AttachStdout: true,
 			AttachStderr: true,
-			WorkingDir:   "/",
+			WorkingDir:   checkoutDir,
 			Image:        b.BaseImage,
+			Volumes:      map[string]struct{}{checkoutDir: {}},
 			Entrypoint:   []string{"sh"},
 			Cmd:          []string{"-c", b.CloneCmd()},
 		},
 	}
+}
+
+func (b *Build) setupContainerOptions() docker.CreateContainerOptions {
+	return docker.CreateContainerOptions{
+		Config: &docker.Config{
+			Tty:          true,
+			AttachStdin:  true,
+			AttachStdout: true,
+			AttachStderr: true,
+			WorkingDir:   "/",
+			Image:        b.BaseImage,
+			Entrypoint:   []string{"sh"},
+			Cmd:          []string{"-c", b.SetupCmd()},
+		},
+	}
+}
+
+func (b *Build) cloneHostConfig() *docker.HostConfig {
+	return &docker.HostConfig{
+		Binds: []string{sshKeyBind()},
+	}
+}
+
+func (b *Build) setupHostConfig() *docker.HostConfig {
+	return &docker.HostConfig{
+		Binds:       []string{sshKeyBind()},
+		VolumesFrom: []string{b.CloneContainer.ID},
+	}
+}
+
+func sshKeyBind() string {
+	sshKey := "/root/.ssh/id_rsa"
+
+	if os.Getenv("SSH_KEY") != "" {
+		sshKey = os.Getenv("SSH_KEY")
+	}
+
+	return fmt.Sprintf("%s:/root/.ssh/id_rsa", sshKey)
+}
+
+func (b *Build) createContainer(container **docker.Container, opts docker.CreateContainerOptions) (<-chan bool, <-chan error) {
+	doneChan := make(chan bool)
+	errorChan := make(chan error)
 
 	b.log("Creating container %v", opts)
 
@@ -273,9 +554,7 @@ func (b *Build) createContainer() (<-chan bool, <-chan error) {
 		defer close(doneChan)
 		defer close(errorChan)
 
-		var err error
-
-		b.Container, err = dockerCli.CreateContainer(opts)
+		c, err := dockerCli.CreateContainer(opts)
 
 		if err != nil {
 			b.log("Could not create container %v: %v", opts, err)
@@ -285,7 +564,14 @@ func (b *Build) createContainer() (<-chan bool, <-chan error) {
 			return
 		}
 
-		b.log("Created container %v", b.Container.ID[:7])
+		*container = c
+
+		b.log("Created container %v", c.ID[:7])
+
+		b.mutex.Lock()
+		b.ContainerIds = append(b.ContainerIds, c.ID)
+		b.save()
+		b.mutex.Unlock()
 
 		doneChan <- true
 	}()
@@ -293,35 +579,24 @@ func (b *Build) createContainer() (<-chan bool, <-chan error) {
 	return doneChan, errorChan
 }
 
-func (b *Build) startContainer() (<-chan bool, <-chan error) {
+func (b *Build) startContainer(container *docker.Container, hostConfig *docker.HostConfig) (<-chan bool, <-chan error) {
 	doneChan := make(chan bool)
 	errorChan := make(chan error)
 
-	b.log("Starting container %s", b.Container.ID[:7])
+	b.log("Starting container %s", container.ID[:7])
 
 	go func() {
-		sshKey := "/root/.ssh/id_rsa"
-
-		if os.Getenv("SSH_KEY") != "" {
-			sshKey = os.Getenv("SSH_KEY")
-		}
-
-		hostConfig := &docker.HostConfig{
-			Binds: []string{
-				fmt.Sprintf("%s:/root/.ssh/id_rsa", sshKey),
-			},
-		}
-		err := dockerCli.StartContainer(b.Container.ID, hostConfig)
+		err := dockerCli.StartContainer(container.ID, hostConfig)
 
 		if err != nil {
-			b.log("Error starting container %s: %v", b.Container.ID[:7], err)
+			b.log("Error starting container %s: %v", container.ID[:7], err)
 
 			errorChan <- err
 
 			return
 		}
 
-		b.log("Started container %s", b.Container.ID[:7])
+		b.log("Started container %s", container.ID[:7])
 
 		doneChan <- true
 	}()
@@ -329,17 +604,19 @@ func (b *Build) startContainer() (<-chan bool, <-chan error) {
 	return doneChan, errorChan
 }
 
-func (b *Build) waitContainer() (<-chan bool, <-chan error) {
+func (b *Build) waitContainer(container *docker.Container) (<-chan bool, <-chan error) {
 	doneChan := make(chan bool)
 	errorChan := make(chan error)
 
-	b.log("Waiting for container %s", b.Container.ID[:7])
+	b.log("Waiting for container %s", container.ID[:7])
 
 	go func() {
 		defer close(doneChan)
 		defer close(errorChan)
 
-		status, err := dockerCli.WaitContainer(b.Container.ID)
+		status, err := dockerCli.WaitContainer(container.ID)
+
+		b.awaitContainerOutput()
 
 		if err != nil {
 			b.log("Error waiting for container: %v", err)
@@ -350,8 +627,8 @@ func (b *Build) waitContainer() (<-chan bool, <-chan error) {
 		}
 
 		if status != 0 {
-			msg := fmt.Sprintf("Container %s exited with status 1: %v", b.Container.ID[:7], err)
-			err := errors.New(msg)
+			msg := fmt.Sprintf("Container %s exited with status %d", container.ID[:7], status)
+			err := &stepError{errors.New(msg)}
 
 			b.log(msg)
 
@@ -360,7 +637,7 @@ func (b *Build) waitContainer() (<-chan bool, <-chan error) {
 			return
 		}
 
-		b.log("Waited for container %s", b.Container.ID[:7])
+		b.log("Waited for container %s", container.ID[:7])
 
 		doneChan <- true
 	}()
@@ -399,6 +676,7 @@ func (b *Build) pullImage(opts docker.PullImageOptions) (<-chan bool, <-chan err
 func (b *Build) pullBaseImage() (<-chan bool, <-chan error) {
 	return b.pullImage(docker.PullImageOptions{
 		Repository: b.BaseImage,
+		Context:    b.ctx,
 	})
 }
 
@@ -437,12 +715,13 @@ func (b *Build) commitContainer() (<-chan bool, <-chan error) {
 	return doneChan, errorChan
 }
 
-func (b *Build) removeContainer() (<-chan bool, <-chan error) {
+func (b *Build) removeContainer(container *docker.Container) (<-chan bool, <-chan error) {
 	doneChan := make(chan bool)
 	errorChan := make(chan error)
 	opts := docker.RemoveContainerOptions{
-		ID:    b.Container.ID,
-		Force: true,
+		ID:            container.ID,
+		RemoveVolumes: true,
+		Force:         true,
 	}
 
 	b.log("Removing container %v", opts)
@@ -487,6 +766,7 @@ func (b *Build) pushImage() (<-chan bool, <-chan error) {
 			Name:         b.ImageName(),
 			OutputStream: &buf,
 			Tag:          b.Id,
+			Context:      b.ctx,
 		}
 		err := dockerCli.PushImage(opts, auth)
 
@@ -515,37 +795,67 @@ func (b *Build) pushImage() (<-chan bool, <-chan error) {
 }
 
 func (b *Build) launchTasks() {
+	for _, task := range b.Tasks {
+		task.Build = b
+		task.BuildId = b.Id
+		task.NewAttempt()
+	}
+
 	go b.taskStatusLoop()
 
 	for _, task := range b.Tasks {
-		go func(t *Task) {
-			fmt.Sprintf("throwing task into chan: %+v", t)
-			t.Build = b
-			t.BuildId = b.Id
-			tasks <- t
-		}(task)
+		b.enqueue(task)
 	}
 }
 
-func (b *Build) Save() error {
-	key := b.RedisKey()
-	conn := redisPool.Get()
-	buildJson, err := json.Marshal(b)
+// enqueue queues the task to be run, unless the build has been cancelled.
+// enqueue queues a task. The queue reads the build's tasks while holding its
+// own mutex, so the build's mutex must not be held.
+func (b *Build) enqueue(task *Task) {
+	if b.cancelled() {
+		return
+	}
 
-	defer conn.Close()
+	queue.Push(task)
+}
 
-	b.log("Saving")
+// requeue puts a task that was not launched back where it was in the queue.
+func (b *Build) requeue(task *Task) {
+	if b.cancelled() {
+		return
+	}
 
-	if err != nil {
-		b.log("Failed to marshal as JSON: %s", err)
+	queue.Requeue(task)
+}
 
-		return err
-	}
+// retry queues another attempt of a task whose last attempt failed.
+// retry starts a new attempt of the task, for the caller to queue once it no
+// longer holds the build's mutex.
+func (b *Build) retry(task *Task) {
+	failed := task.Attempt()
+	attempt := task.NewAttempt()
+
+	b.log("Task %s attempt %s ended %s; retrying as %s", task.Id, failed.Id, failed.Status.GetState(), attempt.Id)
+	task.log("Retrying as attempt %s", attempt.Id)
+}
+
+// Save stores the build. The build's mutex keeps its tasks from changing
+// while they are marshalled.
+func (b *Build) Save() error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	return b.save()
+}
 
-	_, err = conn.Do("SET", key, buildJson)
+// save stores the build for a caller holding its mutex.
+func (b *Build) save() error {
+	b.log("Saving")
+
+	err := store.SaveBuild(b)
 
 	if err != nil {
-		b.log("Failed to set key %s: %v", key, err.Error())
+		b.log("Failed to save: %v", err)
 
 		return err
 	}
@@ -553,56 +863,191 @@ func (b *Build) Save() error {
 	return nil
 }
 
+// taskStatusLoop records the status updates of the build's tasks until every
+// task has reached a terminal state, then decides whether the build passed.
 func (b *Build) taskStatusLoop() {
+	buildIsTakingTooLong := time.After(b.Deadline.Sub(time.Now()))
+	timeoutCheck := time.NewTicker(taskTimeoutCheck)
+
+	defer timeoutCheck.Stop()
+
 	b.log("Entering task status loop")
 
-	for finishedTasks := 0; finishedTasks < len(b.Tasks); {
-		b.log("Began iteration %d in task status loop", finishedTasks)
+	if !runner.NeedsPushedImage() && b.Image != nil {
+		defer func() {
+			doneChan, errorChan := b.removeImage()
 
+			select {
+			case <-doneChan:
+			case <-errorChan:
+			}
+		}()
+	}
+
+	for !b.tasksAreTerminal() {
 		select {
 		case taskStatus := <-b.TaskStatusesChan:
-			state := taskStatus.GetState()
-			taskId := taskStatus.TaskId.GetValue()
+			b.log("Task %s is in the %s state", taskStatus.TaskId.GetValue(), taskStatus.GetState())
 
-			fmt.Sprintf("Task %s is in the %s state", taskId, state)
+			retried := b.updateTaskStatus(taskStatus)
 
-			// Loops through the build tasks to find the one
-			// matching the received task status, so it can update
-			// it's status.
-			for _, task := range b.Tasks {
-				if task.Id != taskId {
-					continue
-				}
-
-				task.Status = taskStatus
-				b.Save()
-				break
+			if retried != nil {
+				b.enqueue(retried)
 			}
+		case <-timeoutCheck.C:
+			b.killTimedOutTasks()
+		case <-buildIsTakingTooLong:
+			b.log("Build timed out waiting for tasks")
+			b.stop()
+			b.transition(BuildTimedOut)
 
-			switch state {
-			case mesos.TaskState_TASK_RUNNING:
-			case mesos.TaskState_TASK_FINISHED:
-				finishedTasks++
-			case mesos.TaskState_TASK_KILLED:
-			case mesos.TaskState_TASK_LOST:
-			case mesos.TaskState_TASK_FAILED:
+			return
+		case <-b.ctx.Done():
+			return
+		}
+	}
+
+	b.transition(b.result())
+}
+
+// killTimedOutTasks kills the tasks that have been running for longer than
+// their timeout. They end up killed and the build carries on without them.
+// updateTaskStatus records a status update with the attempt it belongs to,
+// and returns the task if it is to be retried. Updates for an earlier attempt
+// are only kept in that attempt's history.
+func (b *Build) updateTaskStatus(taskStatus *mesos.TaskStatus) *Task {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	state := taskStatus.GetState()
+	taskId := taskStatus.TaskId.GetValue()
+
+	for _, task := range b.Tasks {
+		attempt := task.AttemptById(taskId)
+
+		if attempt == nil {
+			continue
+		}
+
+		// Updates are delivered concurrently, so one sent before the
+		// attempt ended may arrive after it.
+		if attempt.Status != nil && IsTerminalTaskState(attempt.Status.GetState()) && !IsTerminalTaskState(state) {
+			b.log("Ignoring the %s state of attempt %s, which already ended", state, attempt.Id)
+
+			return nil
+		}
+
+		attempt.Status = taskStatus
+
+		if state == mesos.TaskState_TASK_RUNNING && attempt.StartedAt == nil {
+			now := time.Now()
+			attempt.StartedAt = &now
+		}
+
+		task.log("Attempt %s is in the %s state: %s", attempt.Id, state, taskStatus.GetMessage())
+
+		var retried *Task
+
+		if attempt == task.Attempt() {
+			task.Status = taskStatus
+
+			if task.ShouldRetry() {
+				b.retry(task)
+
+				retried = task
 			}
 		}
+
+		b.save()
+
+		return retried
 	}
 
+	return nil
 }
 
-func (b *Build) SaveAndHandleError(err error) {
-	b.log(err.Error())
-	b.Save()
+func (b *Build) killTimedOutTasks() {
+	timedOut := []*Attempt{}
+
+	b.mutex.Lock()
+
+	for _, task := range b.Tasks {
+		attempt := task.Attempt()
+
+		if task.TimedOut || task.IsTerminal() || attempt == nil || attempt.StartedAt == nil {
+			continue
+		}
+
+		timeout, err := task.ParseTimeout()
+
+		if err != nil || timeout == 0 || time.Since(*attempt.StartedAt) < timeout {
+			continue
+		}
+
+		task.TimedOut = true
+		timedOut = append(timedOut, attempt)
+
+		b.log("Task %s timed out after %s; Killing attempt %s", task.Id, timeout, attempt.Id)
+		task.log("Timed out after %s", timeout)
+	}
+
+	if len(timedOut) != 0 {
+		b.save()
+	}
+
+	b.mutex.Unlock()
+
+	for _, attempt := range timedOut {
+		err := runner.KillTask(attempt.Id)
+
+		if err != nil {
+			b.log("Could not kill task %s: %v", attempt.Id, err)
+		}
+	}
 }
 
-func (b *Build) RedisKey() string {
-	return fmt.Sprintf("pugio:builds:%s", b.Id)
+func (b *Build) tasksAreTerminal() bool {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	for _, task := range b.Tasks {
+		if !task.IsTerminal() {
+			return false
+		}
+	}
+
+	return true
+}
+
+// result is the verdict of a build whose tasks are all terminal: it passed
+// only if every task finished successfully.
+func (b *Build) result() BuildState {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	for _, task := range b.Tasks {
+		if !task.Passed() {
+			return BuildFailed
+		}
+	}
+
+	return BuildPassed
+}
+
+// Task returns the build's task with the given id, or nil if there is none.
+func (b *Build) Task(id string) *Task {
+	for _, task := range b.Tasks {
+		if task.Id == id {
+			return task
+		}
+	}
+
+	return nil
 }
 
-func (b *Build) RedisLogKey() string {
-	return fmt.Sprintf("pugio:builds:%s:log", b.Id)
+func (b *Build) SaveAndHandleError(err error) {
+	b.log(err.Error())
+	b.Save()
 }
 
 func (b *Build) GitRepo() string {
@@ -613,8 +1058,30 @@ func (b *Build) ImageName() string {
 	return fmt.Sprintf("docker.corp.adobe.com/typekit/%s", b.App)
 }
 
+// TaskImage is the reference of the image committed for this build, which
+// its tasks run from.
+func (b *Build) TaskImage() string {
+	return fmt.Sprintf("%s:%s", b.ImageName(), b.Id)
+}
+
+func (b *Build) ManifestPath() string {
+	return path.Join(checkoutDir, b.App, manifestFile)
+}
+
 func (b *Build) CloneCmd() string {
-	return fmt.Sprintf("(ssh -o StrictHostKeyChecking=no git@git.corp.adobe.com || true) && rm -rf %s && git clone --depth 1 --branch %s %s && cd %s && bundle install --jobs 4 --deployment", b.App, b.Branch, b.GitRepo(), b.App)
+	return fmt.Sprintf("(ssh -o StrictHostKeyChecking=no git@git.corp.adobe.com || true) && rm -rf %s && git clone --depth 1 --branch %s %s %s", b.App, b.Branch, b.GitRepo(), b.App)
+}
+
+// SetupCmd copies the checkout out of the clone container's volume, since
+// volumes are not part of committed images, and runs the manifest's setup.
+func (b *Build) SetupCmd() string {
+	cmd := fmt.Sprintf("rm -rf /%s && cp -a %s /%s && cd /%s", b.App, path.Join(checkoutDir, b.App), b.App, b.App)
+
+	if b.Manifest != nil && b.Manifest.Setup != "" {
+		cmd = fmt.Sprintf("%s && %s", cmd, b.Manifest.Setup)
+	}
+
+	return cmd
 }
 
 func (b *Build) removeImage() (<-chan bool, <-chan error) {
@@ -648,55 +1115,117 @@ func (b *Build) removeImage() (<-chan bool, <-chan error) {
 func (b *Build) log(msg string, args ...interface{}) {
 	msg = fmt.Sprintf(msg, args...)
 
-	conn := redisPool.Get()
-
-	defer conn.Close()
-
-	_, err := conn.Do("RPUSH", b.RedisLogKey(), fmt.Sprintf("[%s] %s", time.Now().String(), msg))
+	err := store.AppendLog(b.Id, "", fmt.Sprintf("[%s] %s", time.Now().String(), msg))
 
 	if err != nil {
-		log.Printf(err.Error())
+		log.Print(err)
 	}
 
 	log.Printf("[Build %s] %s", b.Id, msg)
 }
 
-func (b *Build) containerLogs() (<-chan bool, <-chan error) {
+// containerLogs attaches to a container before it is started and records
+// every line it outputs in the build log, tagged with the container's name so
+// it stands apart from orchestration messages. It is done once attached.
+func (b *Build) containerLogs(container *docker.Container, name string) (<-chan bool, <-chan error) {
 	doneChan := make(chan bool)
 	errorChan := make(chan error)
 
+	b.log("Attaching to container %s", container.ID[:7])
+
 	go func() {
 		reader, writer := io.Pipe()
+		attached := make(chan struct{})
+		attachErrorChan := make(chan error, 1)
 		opts := docker.AttachToContainerOptions{
-			Container:    b.Container.ID,
+			Container:    container.ID,
 			OutputStream: writer,
 			ErrorStream:  writer,
 			Stdout:       true,
 			Stderr:       true,
 			Stream:       true,
 			Logs:         true,
+			// The clone and setup containers have a TTY, so their
+			// output is not multiplexed.
+			RawTerminal: true,
+			Success:     attached,
 		}
 
+		b.containerOutput.Add(1)
+
 		go func() {
 			err := dockerCli.AttachToContainer(opts)
 
-			if err != nil {
-				errorChan <- err
-			}
+			writer.Close()
+
+			attachErrorChan <- err
 		}()
 
 		go func(r io.Reader) {
+			defer b.containerOutput.Done()
+
 			scanner := bufio.NewScanner(r)
 
 			for scanner.Scan() {
-				log.Printf("%s\n", scanner.Text())
+				b.logContainerOutput(name, strings.TrimRight(scanner.Text(), "\r"))
 			}
 
 			if err := scanner.Err(); err != nil {
-				log.Printf("There was an error with the scanner in attached container: %v", err)
+				b.log("There was an error with the scanner in attached container: %v", err)
 			}
 		}(reader)
+
+		select {
+		case <-attached:
+			attached <- struct{}{}
+
+			b.log("Attached to container %s", container.ID[:7])
+
+			go func() {
+				err := <-attachErrorChan
+
+				if err != nil {
+					b.log("Error reading the output of container %s: %v", container.ID[:7], err)
+				}
+			}()
+
+			doneChan <- true
+		case err := <-attachErrorChan:
+			if err == nil {
+				err = fmt.Errorf("Container %s closed the attached stream", container.ID[:7])
+			}
+
+			b.log("Error attaching to container %s: %v", container.ID[:7], err)
+
+			errorChan <- err
+		}
 	}()
 
 	return doneChan, errorChan
 }
+
+// awaitContainerOutput gives the output of an exited container a moment to be
+// recorded before the build carries on.
+func (b *Build) awaitContainerOutput() {
+	recorded := make(chan bool)
+
+	go func() {
+		b.containerOutput.Wait()
+		close(recorded)
+	}()
+
+	select {
+	case <-recorded:
+	case <-time.After(10 * time.Second):
+	}
+}
+
+func (b *Build) logContainerOutput(name string, line string) {
+	err := store.AppendLog(b.Id, "", fmt.Sprintf("[%s] [%s] %s", time.Now().String(), name, line))
+
+	if err != nil {
+		log.Print(err)
+	}
+
+	log.Printf("[Build %s] [%s] %s", b.Id, name, line)
+}
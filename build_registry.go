@@ -0,0 +1,53 @@
+package main
+
+import (
+	"sync"
+)
+
+// BuildRegistry keeps the builds this process is running, so requests can
+// reach the goroutines and channels of a build rather than its saved copy.
+type BuildRegistry struct {
+	mutex  sync.Mutex
+	builds map[string]*Build
+}
+
+func NewBuildRegistry() *BuildRegistry {
+	return &BuildRegistry{
+		builds: make(map[string]*Build),
+	}
+}
+
+func (r *BuildRegistry) Add(b *Build) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	r.builds[b.Id] = b
+}
+
+func (r *BuildRegistry) Get(id string) *Build {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	return r.builds[id]
+}
+
+func (r *BuildRegistry) Remove(id string) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	delete(r.builds, id)
+}
+
+// All returns the running builds.
+func (r *BuildRegistry) All() []*Build {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	builds := []*Build{}
+
+	for _, build := range r.builds {
+		builds = append(builds, build)
+	}
+
+	return builds
+}
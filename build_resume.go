@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"log"
+
+	mesos "github.com/mesos/mesos-go/mesosproto"
+)
+
+// resumeBuilds picks up the builds left unfinished by the previous process.
+// It must run before the runner, so status updates for their tasks have a
+// build to go to.
+func resumeBuilds() error {
+	builds, err := store.ListUnfinishedBuilds()
+
+	if err != nil {
+		return err
+	}
+
+	for _, b := range builds {
+		log.Printf("Resuming build %s in the %s state", b.Id, b.State)
+
+		b.restore()
+		runningBuilds.Add(b)
+		b.Resume()
+	}
+
+	return nil
+}
+
+// restore recreates the parts of a build that are not saved with it.
+func (b *Build) restore() {
+	b.ctx, b.cancel = context.WithCancel(context.Background())
+	b.TaskStatusesChan = make(chan *mesos.TaskStatus)
+
+	for _, task := range b.Tasks {
+		task.Build = b
+		task.BuildId = b.Id
+	}
+}
+
+// Resume carries on with a build loaded from the store. A queued build has
+// not started, so it is started over, and a testing build goes back to
+// waiting on its tasks. The image stages cannot be resumed, since their
+// containers were attached to the previous process, so such a build errors.
+func (b *Build) Resume() {
+	switch b.State {
+	case BuildQueued:
+		b.log("Starting build again after a restart")
+
+		go b.Build()
+	case BuildTesting:
+		b.log("Resuming tasks after a restart")
+
+		// The image is removed once the tasks are done when it was
+		// never pushed.
+		if !runner.NeedsPushedImage() {
+			image, err := dockerCli.InspectImage(b.TaskImage())
+
+			if err != nil {
+				b.log("Could not find image %s: %v", b.TaskImage(), err)
+			} else {
+				b.Image = image
+			}
+		}
+
+		for _, task := range b.Tasks {
+			if task.IsTerminal() {
+				continue
+			}
+
+			if task.Attempt() == nil {
+				task.NewAttempt()
+			}
+
+			if task.Attempt().LaunchedAt == nil {
+				b.enqueue(task)
+
+				continue
+			}
+
+			runner.Adopt(task)
+		}
+
+		go b.taskStatusLoop()
+	default:
+		b.log("Build was interrupted in the %s state by a restart", b.State)
+		b.removeContainers()
+		b.transition(BuildErrored)
+	}
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"time"
+)
+
+type BuildState string
+
+const (
+	BuildQueued     BuildState = "queued"
+	BuildPulling    BuildState = "pulling"
+	BuildCloning    BuildState = "cloning"
+	BuildCommitting BuildState = "committing"
+	BuildPushing    BuildState = "pushing"
+	BuildTesting    BuildState = "testing"
+	BuildPassed     BuildState = "passed"
+	BuildFailed     BuildState = "failed"
+	BuildErrored    BuildState = "errored"
+	BuildCancelled  BuildState = "cancelled"
+	BuildTimedOut   BuildState = "timed_out"
+)
+
+// Stage records how long a build spent in one of its non-terminal states. A
+// build may pass through the same state more than once, e.g. it pulls both the
+// image it clones with and the base image named by the manifest.
+type Stage struct {
+	State      BuildState `json:"state"`
+	StartedAt  time.Time  `json:"startedAt"`
+	FinishedAt *time.Time `json:"finishedAt,omitempty"`
+}
+
+func (s BuildState) IsTerminal() bool {
+	switch s {
+	case BuildPassed, BuildFailed, BuildErrored, BuildCancelled, BuildTimedOut:
+		return true
+	}
+
+	return false
+}
+
+// transition moves the build into the given state, closing the current stage
+// and opening a new one unless the state is terminal, and saves the build. A
+// build never leaves a terminal state.
+func (b *Build) transition(state BuildState) error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	now := time.Now()
+
+	if b.State == state || b.State.IsTerminal() {
+		return nil
+	}
+
+	if len(b.Stages) != 0 {
+		stage := b.Stages[len(b.Stages)-1]
+
+		if stage.FinishedAt == nil {
+			stage.FinishedAt = &now
+		}
+	}
+
+	if state.IsTerminal() {
+		b.FinishedAt = &now
+
+		runningBuilds.Remove(b.Id)
+	} else {
+		b.Stages = append(b.Stages, &Stage{State: state, StartedAt: now})
+	}
+
+	b.log("Build is %s", state)
+
+	b.State = state
+
+	return b.save()
+}
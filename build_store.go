@@ -0,0 +1,136 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+)
+
+var (
+	errBuildNotFound = errors.New("Build not found")
+)
+
+// BuildStore persists builds and their logs. A log belongs to a build, or to
+// one of its tasks when a task id is given, and is a list of lines that can be
+// read from any index and subscribed to for lines appended later.
+type BuildStore interface {
+	// CreateBuild saves a new build and adds it to the list of builds.
+	CreateBuild(b *Build) error
+	SaveBuild(b *Build) error
+	GetBuild(id string) (*Build, error)
+	// ListBuilds returns up to limit builds, the most recent first.
+	ListBuilds(limit int) ([]*Build, error)
+	// ListUnfinishedBuilds returns the builds not yet in a terminal state.
+	ListUnfinishedBuilds() ([]*Build, error)
+	AppendLog(buildId string, taskId string, line string) error
+	ReadLog(buildId string, taskId string, start int) ([]string, error)
+	// SubscribeLog sends lines appended to a log until done is closed or
+	// the subscription fails, then closes the returned channel. Lines may
+	// arrive out of order or be skipped, so their index is included.
+	SubscribeLog(buildId string, taskId string, done <-chan bool) (<-chan LogLine, error)
+	// FrameworkId returns the id Mesos last assigned to the framework, or
+	// an empty string if it has none.
+	FrameworkId() (string, error)
+	// SaveFrameworkId keeps the framework's id, so a restarted Gladius can
+	// fail over to it. An empty id forgets it.
+	SaveFrameworkId(id string) error
+}
+
+type LogLine struct {
+	Index int
+	Text  string
+}
+
+// NewBuildStore creates the store named by BUILD_STORE: redis, which is the
+// default, memory or bolt.
+func NewBuildStore() (BuildStore, error) {
+	switch os.Getenv("BUILD_STORE") {
+	case "", "redis":
+		if os.Getenv("REDIS_IDLE_TIMEOUT") == "" {
+			return nil, errors.New("REDIS_IDLE_TIMEOUT must be set")
+		}
+
+		if os.Getenv("REDIS_MAX_IDLE") == "" {
+			return nil, errors.New("REDIS_MAX_IDLE must be set")
+		}
+
+		return NewRedisStore(), nil
+	case "memory":
+		return NewMemoryStore(), nil
+	case "bolt":
+		path := "gladius.db"
+
+		if os.Getenv("BOLT_PATH") != "" {
+			path = os.Getenv("BOLT_PATH")
+		}
+
+		return NewBoltStore(path)
+	default:
+		return nil, fmt.Errorf("Unknown BUILD_STORE %s", os.Getenv("BUILD_STORE"))
+	}
+}
+
+func logName(buildId string, taskId string) string {
+	if taskId == "" {
+		return fmt.Sprintf("builds:%s", buildId)
+	}
+
+	return fmt.Sprintf("builds:%s:tasks:%s", buildId, taskId)
+}
+
+// logBroadcaster fans appended log lines out to subscribers within this
+// process, for the stores that have no notification mechanism of their own.
+// A subscriber that falls behind misses lines rather than blocking writers.
+type logBroadcaster struct {
+	mutex       sync.Mutex
+	subscribers map[string]map[chan LogLine]bool
+}
+
+func newLogBroadcaster() *logBroadcaster {
+	return &logBroadcaster{
+		subscribers: make(map[string]map[chan LogLine]bool),
+	}
+}
+
+func (lb *logBroadcaster) subscribe(name string, done <-chan bool) <-chan LogLine {
+	lines := make(chan LogLine, 64)
+
+	lb.mutex.Lock()
+
+	if lb.subscribers[name] == nil {
+		lb.subscribers[name] = make(map[chan LogLine]bool)
+	}
+
+	lb.subscribers[name][lines] = true
+	lb.mutex.Unlock()
+
+	go func() {
+		<-done
+
+		lb.mutex.Lock()
+		defer lb.mutex.Unlock()
+
+		delete(lb.subscribers[name], lines)
+
+		if len(lb.subscribers[name]) == 0 {
+			delete(lb.subscribers, name)
+		}
+
+		close(lines)
+	}()
+
+	return lines
+}
+
+func (lb *logBroadcaster) publish(name string, line LogLine) {
+	lb.mutex.Lock()
+	defer lb.mutex.Unlock()
+
+	for lines := range lb.subscribers[name] {
+		select {
+		case lines <- line:
+		default:
+		}
+	}
+}
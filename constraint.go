@@ -0,0 +1,134 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	mesos "github.com/mesos/mesos-go/mesosproto"
+)
+
+const (
+	uniqueHostConstraint  = "unique_host"
+	maxPerSlaveConstraint = "max_per_slave"
+	hostnameAttribute     = "hostname"
+)
+
+// Constraint restricts the offers a task may be launched with. It is written
+// as `attribute:value` to require a slave attribute, or `hostname:value`, as
+// `unique_host` to keep a build's tasks on separate hosts, or as
+// `max_per_slave:N` to run at most N of a build's tasks on one slave.
+type Constraint struct {
+	Attribute   string
+	Value       string
+	UniqueHost  bool
+	MaxPerSlave int
+}
+
+func ParseConstraint(s string) (*Constraint, error) {
+	if s == uniqueHostConstraint {
+		return &Constraint{UniqueHost: true}, nil
+	}
+
+	parts := strings.SplitN(s, ":", 2)
+
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return nil, fmt.Errorf("Constraint %q is not of the form attribute:value", s)
+	}
+
+	if parts[0] == maxPerSlaveConstraint {
+		max, err := strconv.Atoi(parts[1])
+
+		if err != nil || max < 1 {
+			return nil, fmt.Errorf("Constraint %q needs a positive number of tasks", s)
+		}
+
+		return &Constraint{MaxPerSlave: max}, nil
+	}
+
+	return &Constraint{Attribute: parts[0], Value: parts[1]}, nil
+}
+
+// Allows reports whether the task may be launched with the offer, given the
+// tasks of its build already running.
+func (c *Constraint) Allows(task *Task, offer *mesos.Offer) bool {
+	switch {
+	case c.UniqueHost:
+		return len(runningSiblings(task, func(attempt *Attempt) bool {
+			return attempt.Hostname == offer.GetHostname()
+		})) == 0
+	case c.MaxPerSlave != 0:
+		return len(runningSiblings(task, func(attempt *Attempt) bool {
+			return attempt.SlaveId == offer.SlaveId.GetValue()
+		})) < c.MaxPerSlave
+	case c.Attribute == hostnameAttribute:
+		return offer.GetHostname() == c.Value
+	}
+
+	for _, attribute := range offer.Attributes {
+		if attribute.GetName() == c.Attribute && attributeHasValue(attribute, c.Value) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func attributeHasValue(attribute *mesos.Attribute, value string) bool {
+	switch attribute.GetType() {
+	case mesos.Value_TEXT:
+		return attribute.GetText().GetValue() == value
+	case mesos.Value_SCALAR:
+		return strconv.FormatFloat(attribute.GetScalar().GetValue(), 'f', -1, 64) == value
+	case mesos.Value_SET:
+		for _, item := range attribute.GetSet().GetItem() {
+			if item == value {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// runningSiblings returns the launched, unfinished attempts of the other tasks
+// of the task's build that match.
+func runningSiblings(task *Task, match func(*Attempt) bool) []*Attempt {
+	task.Build.mutex.Lock()
+	defer task.Build.mutex.Unlock()
+
+	attempts := []*Attempt{}
+
+	for _, sibling := range task.Build.Tasks {
+		attempt := sibling.Attempt()
+
+		if sibling == task || attempt == nil || attempt.LaunchedAt == nil || sibling.IsTerminal() {
+			continue
+		}
+
+		if match(attempt) {
+			attempts = append(attempts, attempt)
+		}
+	}
+
+	return attempts
+}
+
+// AcceptsOffer reports whether every constraint of the task allows the offer.
+// Constraints are validated with the manifest, so any that fail to parse are
+// ignored.
+func (t *Task) AcceptsOffer(offer *mesos.Offer) bool {
+	for _, s := range t.Constraints {
+		constraint, err := ParseConstraint(s)
+
+		if err != nil {
+			continue
+		}
+
+		if !constraint.Allows(t, offer) {
+			return false
+		}
+	}
+
+	return true
+}
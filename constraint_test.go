@@ -0,0 +1,121 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	proto "github.com/gogo/protobuf/proto"
+	mesos "github.com/mesos/mesos-go/mesosproto"
+	util "github.com/mesos/mesos-go/mesosutil"
+)
+
+func TestParseConstraint(t *testing.T) {
+	tests := []struct {
+		constraint string
+		want       *Constraint
+	}{
+		{"rack:a", &Constraint{Attribute: "rack", Value: "a"}},
+		{"hostname:h1", &Constraint{Attribute: "hostname", Value: "h1"}},
+		{"zone:us:east", &Constraint{Attribute: "zone", Value: "us:east"}},
+		{"unique_host", &Constraint{UniqueHost: true}},
+		{"max_per_slave:2", &Constraint{MaxPerSlave: 2}},
+		{"rack", nil},
+		{":a", nil},
+		{"rack:", nil},
+		{"max_per_slave:0", nil},
+		{"max_per_slave:many", nil},
+	}
+
+	for _, test := range tests {
+		constraint, err := ParseConstraint(test.constraint)
+
+		if test.want == nil {
+			if err == nil {
+				t.Errorf("%s: parsed %+v, want an error", test.constraint, constraint)
+			}
+
+			continue
+		}
+
+		if err != nil || !reflect.DeepEqual(constraint, test.want) {
+			t.Errorf("%s: parsed %+v, %v, want %+v", test.constraint, constraint, err, test.want)
+		}
+	}
+}
+
+func constraintOffer(hostname string, slaveId string) *mesos.Offer {
+	return &mesos.Offer{
+		Hostname: proto.String(hostname),
+		SlaveId:  util.NewSlaveID(slaveId),
+		Attributes: []*mesos.Attribute{
+			{
+				Name: proto.String("rack"),
+				Type: mesos.Value_TEXT.Enum(),
+				Text: &mesos.Value_Text{Value: proto.String("a")},
+			},
+			{
+				Name:   proto.String("cores"),
+				Type:   mesos.Value_SCALAR.Enum(),
+				Scalar: &mesos.Value_Scalar{Value: proto.Float64(4)},
+			},
+			{
+				Name: proto.String("zones"),
+				Type: mesos.Value_SET.Enum(),
+				Set:  &mesos.Value_Set{Item: []string{"x", "y"}},
+			},
+		},
+	}
+}
+
+func TestConstraintAllows(t *testing.T) {
+	build := &Build{Id: "build"}
+	task := &Task{Id: "task", Build: build}
+	running := &Task{Id: "running", Build: build}
+	finished := &Task{Id: "finished", Build: build}
+	build.Tasks = []*Task{task, running, finished}
+
+	task.NewAttempt()
+
+	attempt := running.NewAttempt()
+	attempt.LaunchedAt = &build.CreatedAt
+	attempt.Hostname = "h1"
+	attempt.SlaveId = "s1"
+
+	attempt = finished.NewAttempt()
+	attempt.LaunchedAt = &build.CreatedAt
+	attempt.Hostname = "h2"
+	attempt.SlaveId = "s2"
+	finished.Status = &mesos.TaskStatus{State: mesos.TaskState_TASK_FINISHED.Enum()}
+
+	tests := []struct {
+		constraint string
+		offer      *mesos.Offer
+		allows     bool
+	}{
+		{"rack:a", constraintOffer("h1", "s1"), true},
+		{"rack:b", constraintOffer("h1", "s1"), false},
+		{"cores:4", constraintOffer("h1", "s1"), true},
+		{"zones:y", constraintOffer("h1", "s1"), true},
+		{"zones:z", constraintOffer("h1", "s1"), false},
+		{"disk:ssd", constraintOffer("h1", "s1"), false},
+		{"hostname:h1", constraintOffer("h1", "s1"), true},
+		{"hostname:h1", constraintOffer("h2", "s2"), false},
+		{"unique_host", constraintOffer("h1", "s1"), false},
+		{"unique_host", constraintOffer("h2", "s2"), true},
+		{"max_per_slave:1", constraintOffer("h1", "s1"), false},
+		{"max_per_slave:2", constraintOffer("h1", "s1"), true},
+		{"max_per_slave:1", constraintOffer("h2", "s2"), true},
+	}
+
+	for _, test := range tests {
+		constraint, err := ParseConstraint(test.constraint)
+
+		if err != nil {
+			t.Fatalf("%s: %v", test.constraint, err)
+		}
+
+		if constraint.Allows(task, test.offer) != test.allows {
+			t.Errorf("%s on %s: allowed %v, want %v", test.constraint, test.offer.GetHostname(), !test.allows, test.allows)
+		}
+	}
+}
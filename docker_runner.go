@@ -0,0 +1,223 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+
+	docker "github.com/fsouza/go-dockerclient"
+	proto "github.com/gogo/protobuf/proto"
+	mesos "github.com/mesos/mesos-go/mesosproto"
+	util "github.com/mesos/mesos-go/mesosutil"
+)
+
+// DockerRunner runs tasks as containers of the build image on the Docker
+// daemon that built it, at most concurrency at a time, so the whole pipeline
+// can run without a Mesos cluster.
+type DockerRunner struct {
+	concurrency int
+	mutex       sync.Mutex
+	containers  map[string]string
+	killed      map[string]bool
+}
+
+func NewDockerRunner(concurrency int) *DockerRunner {
+	return &DockerRunner{
+		concurrency: concurrency,
+		containers:  make(map[string]string),
+		killed:      make(map[string]bool),
+	}
+}
+
+// Run starts the workers, which run for as long as Gladius does, so it never
+// returns.
+func (r *DockerRunner) Run() error {
+	for i := 0; i < r.concurrency; i++ {
+		go func() {
+			for {
+				r.runTask(queue.Wait())
+			}
+		}()
+	}
+
+	select {}
+}
+
+func (r *DockerRunner) KillTask(id string) error {
+	r.mutex.Lock()
+	containerId, ok := r.containers[id]
+
+	if ok {
+		r.killed[id] = true
+	}
+
+	r.mutex.Unlock()
+
+	if !ok {
+		return nil
+	}
+
+	return dockerCli.KillContainer(docker.KillContainerOptions{ID: containerId})
+}
+
+// Adopt reports the attempt as lost, since its container was started by the
+// previous process and its output can no longer be followed.
+func (r *DockerRunner) Adopt(task *Task) {
+	go r.sendStatus(task, mesos.TaskState_TASK_LOST, "Gladius restarted while the task was running")
+}
+
+func (r *DockerRunner) NeedsPushedImage() bool {
+	return false
+}
+
+// runTask runs the current attempt of a task to completion. Failures of the
+// Docker daemon are reported as lost tasks, so the retry policy applies.
+func (r *DockerRunner) runTask(task *Task) {
+	if task.Build.cancelled() {
+		return
+	}
+
+	now := time.Now()
+
+	task.Build.mutex.Lock()
+	attempt := task.Attempt()
+	attempt.LaunchedAt = &now
+	task.Build.mutex.Unlock()
+
+	opts := docker.CreateContainerOptions{
+		Config: &docker.Config{
+			AttachStdout: true,
+			AttachStderr: true,
+			WorkingDir:   "/" + task.Build.App,
+			Image:        task.Build.TaskImage(),
+			Entrypoint:   []string{"sh"},
+			Cmd:          []string{"-c", task.Cmd},
+		},
+	}
+
+	task.log("Launching attempt %s in a local container", attempt.Id)
+
+	container, err := dockerCli.CreateContainer(opts)
+
+	if err != nil {
+		r.sendStatus(task, mesos.TaskState_TASK_LOST, fmt.Sprintf("Could not create container: %v", err))
+
+		return
+	}
+
+	r.mutex.Lock()
+	r.containers[attempt.Id] = container.ID
+	r.mutex.Unlock()
+
+	defer func() {
+		r.mutex.Lock()
+		delete(r.containers, attempt.Id)
+		delete(r.killed, attempt.Id)
+		r.mutex.Unlock()
+
+		err := dockerCli.RemoveContainer(docker.RemoveContainerOptions{ID: container.ID, Force: true})
+
+		if err != nil {
+			task.log("Error removing container %s: %v", container.ID[:7], err)
+		}
+	}()
+
+	hostConfig := &docker.HostConfig{
+		CPUShares: int64(task.Cpus * 1024),
+		Memory:    int64(task.Mem * 1024 * 1024),
+	}
+	err = dockerCli.StartContainer(container.ID, hostConfig)
+
+	if err != nil {
+		r.sendStatus(task, mesos.TaskState_TASK_LOST, fmt.Sprintf("Could not start container: %v", err))
+
+		return
+	}
+
+	r.sendStatus(task, mesos.TaskState_TASK_RUNNING, fmt.Sprintf("Running in container %s", container.ID[:7]))
+
+	output := r.recordOutput(task, container)
+	exitCode, err := dockerCli.WaitContainer(container.ID)
+
+	select {
+	case <-output:
+	case <-time.After(10 * time.Second):
+	}
+
+	r.mutex.Lock()
+	killed := r.killed[attempt.Id]
+	r.mutex.Unlock()
+
+	switch {
+	case killed:
+		r.sendStatus(task, mesos.TaskState_TASK_KILLED, "Container was killed")
+	case err != nil:
+		r.sendStatus(task, mesos.TaskState_TASK_LOST, fmt.Sprintf("Could not wait for container: %v", err))
+	case exitCode == 0:
+		r.sendStatus(task, mesos.TaskState_TASK_FINISHED, "Command exited with status 0")
+	default:
+		r.sendStatus(task, mesos.TaskState_TASK_FAILED, fmt.Sprintf("Command exited with status %d", exitCode))
+	}
+}
+
+// recordOutput follows the container's output into the task log, like an
+// executor sending its output back. The channel closes once it ends.
+func (r *DockerRunner) recordOutput(task *Task, container *docker.Container) <-chan bool {
+	doneChan := make(chan bool)
+	reader, writer := io.Pipe()
+	opts := docker.LogsOptions{
+		Container:    container.ID,
+		OutputStream: writer,
+		ErrorStream:  writer,
+		Stdout:       true,
+		Stderr:       true,
+		Follow:       true,
+	}
+
+	go func() {
+		err := dockerCli.Logs(opts)
+
+		writer.Close()
+
+		if err != nil {
+			task.log("Error following container %s: %v", container.ID[:7], err)
+		}
+	}()
+
+	go func() {
+		defer close(doneChan)
+
+		scanner := bufio.NewScanner(reader)
+
+		for scanner.Scan() {
+			output := &TaskOutput{
+				BuildId: task.BuildId,
+				TaskId:  task.Id,
+				Output:  strings.TrimRight(scanner.Text(), "\r"),
+			}
+
+			output.Save()
+		}
+	}()
+
+	return doneChan
+}
+
+// sendStatus reports the state of the task's current attempt to its build,
+// in the shape a Mesos executor would.
+func (r *DockerRunner) sendStatus(task *Task, state mesos.TaskState, message string) {
+	status := &mesos.TaskStatus{
+		TaskId:    util.NewTaskID(task.Attempt().Id),
+		State:     state.Enum(),
+		Message:   proto.String(message),
+		Timestamp: proto.Float64(float64(time.Now().UnixNano()) / float64(time.Second)),
+	}
+
+	select {
+	case task.Build.TaskStatusesChan <- status:
+	case <-task.Build.ctx.Done():
+	}
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	logStreamKeepAlive     = 15 * time.Second
+	logStreamStateInterval = 1 * time.Second
+)
+
+// buildFinished reports whether the build's logs can no longer grow.
+func buildFinished(id string) bool {
+	if runningBuilds.Get(id) != nil {
+		return false
+	}
+
+	build, err := store.GetBuild(id)
+
+	return err != nil || build.State.IsTerminal()
+}
+
+// streamLog sends the lines of a log as Server-Sent Events, starting after the
+// Last-Event-ID the client reconnected with, and keeps pushing new lines until
+// the build finishes or the client goes away. The build log stream also sends
+// the build itself as a `build` event whenever its saved state changes.
+func (r *Routes) streamLog(w http.ResponseWriter, req *http.Request, buildId string, taskId string) {
+	flusher, ok := w.(http.Flusher)
+
+	if !ok {
+		log.Printf("Streaming is not supported by %T", w)
+		w.WriteHeader(http.StatusInternalServerError)
+
+		return
+	}
+
+	_, err := store.GetBuild(buildId)
+
+	if err == errBuildNotFound {
+		w.WriteHeader(http.StatusNotFound)
+
+		return
+	}
+
+	if err != nil {
+		log.Printf("Could not load build %s: %v", buildId, err)
+		w.WriteHeader(http.StatusInternalServerError)
+
+		return
+	}
+
+	// Subscribing before reading the backlog ensures no line is missed;
+	// lines seen in both are told apart by their index.
+	done := make(chan bool)
+
+	defer close(done)
+
+	lines, err := store.SubscribeLog(buildId, taskId, done)
+
+	if err != nil {
+		log.Printf("Could not subscribe to the log of build %s: %v", buildId, err)
+		w.WriteHeader(http.StatusInternalServerError)
+
+		return
+	}
+
+	next := 0
+
+	if lastEventId, err := strconv.Atoi(req.Header.Get("Last-Event-ID")); err == nil {
+		next = lastEventId + 1
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+
+	sendBacklog := func() bool {
+		backlog, err := store.ReadLog(buildId, taskId, next)
+
+		if err != nil {
+			log.Printf("Could not read the log of build %s: %v", buildId, err)
+
+			return false
+		}
+
+		for _, text := range backlog {
+			writeEvent(w, next, text)
+			next++
+		}
+
+		flusher.Flush()
+
+		return true
+	}
+
+	var sentBuild []byte
+
+	// Build events carry no id, so they leave where the log resumes from
+	// unchanged.
+	sendBuild := func() bool {
+		if taskId != "" {
+			return true
+		}
+
+		build, err := store.GetBuild(buildId)
+
+		if err != nil {
+			log.Printf("Could not load build %s: %v", buildId, err)
+
+			return false
+		}
+
+		body, err := json.Marshal(build)
+
+		if err != nil {
+			log.Printf("Could not marshal build %s: %v", buildId, err)
+
+			return false
+		}
+
+		if bytes.Equal(body, sentBuild) {
+			return true
+		}
+
+		fmt.Fprintf(w, "event: build\ndata: %s\n\n", body)
+		flusher.Flush()
+
+		sentBuild = body
+
+		return true
+	}
+
+	if !sendBacklog() || !sendBuild() {
+		return
+	}
+
+	keepAlive := time.NewTicker(logStreamKeepAlive)
+	stateCheck := time.NewTicker(logStreamStateInterval)
+
+	defer keepAlive.Stop()
+	defer stateCheck.Stop()
+
+	for {
+		select {
+		case line, ok := <-lines:
+			if !ok {
+				return
+			}
+
+			if line.Index < next {
+				continue
+			}
+
+			// Lines may be published out of order or dropped, so a
+			// gap is filled from the log itself.
+			if line.Index > next {
+				if !sendBacklog() {
+					return
+				}
+
+				continue
+			}
+
+			writeEvent(w, line.Index, line.Text)
+			flusher.Flush()
+
+			next = line.Index + 1
+		case <-stateCheck.C:
+			if !sendBuild() {
+				return
+			}
+		case <-keepAlive.C:
+			if buildFinished(buildId) {
+				if sendBacklog() && sendBuild() {
+					fmt.Fprint(w, "event: end\ndata: \n\n")
+					flusher.Flush()
+				}
+
+				return
+			}
+
+			fmt.Fprint(w, ": keepalive\n\n")
+			flusher.Flush()
+		case <-req.Context().Done():
+			return
+		}
+	}
+}
+
+func writeEvent(w http.ResponseWriter, id int, text string) {
+	fmt.Fprintf(w, "id: %d\n", id)
+
+	for _, line := range strings.Split(text, "\n") {
+		fmt.Fprintf(w, "data: %s\n", line)
+	}
+
+	fmt.Fprint(w, "\n")
+}
@@ -10,69 +10,96 @@ import (
 	"time"
 
 	docker "github.com/fsouza/go-dockerclient"
-	redis "github.com/garyburd/redigo/redis"
 	sched "github.com/mesos/mesos-go/scheduler"
 )
 
 var (
 	quit             chan bool
-	tasks            chan *Task
+	queue            *TaskQueue
 	routes           *Routes
+	runningBuilds    *BuildRegistry
 	dockerCli        *docker.Client
 	executorId       string
 	executorCommand  string
+	executorScope    string
+	taskExecutor     string
 	cpusPerTask      float64
 	memoryPerTask    float64
+	diskPerTask      float64
+	taskMaxAttempts  int
 	frameworkName    string
+	frameworkRole    string
 	gladiusPort      string
-	redisPool        *redis.Pool
+	store            BuildStore
 	redisIdleTimeout time.Duration
 	redisMaxIdle     int
 	schedulerDriver  *sched.MesosSchedulerDriver
+	runner           Runner
 )
 
-func init() {
+// setup reads the configuration, resumes unfinished builds and starts the API
+// and the runner.
+func setup() {
 	var (
-		dockerCliErr       error
-		schedulerDriverErr error
-		cpusParseErr       error
-		memoryParseErr     error
+		dockerCliErr     error
+		storeErr         error
+		runnerErr        error
+		cpusParseErr     error
+		memoryParseErr   error
+		diskParseErr     error
+		attemptsParseErr error
 	)
 
 	if os.Getenv("CPUS_PER_TASK") == "" {
 		log.Fatal("CPUS_PER_TASK must be set")
 	}
 
-	if os.Getenv("EXECUTOR_COMMAND") == "" {
-		log.Fatal("EXECUTOR_COMMAND must be set")
+	taskExecutor = gladiusTaskExecutor
+
+	if os.Getenv("TASK_EXECUTOR") != "" {
+		taskExecutor = os.Getenv("TASK_EXECUTOR")
 	}
 
-	if os.Getenv("EXECUTOR_ID") == "" {
-		log.Fatal("EXECUTOR_ID must be set")
+	if taskExecutor != gladiusTaskExecutor && taskExecutor != dockerTaskExecutor {
+		log.Fatal("TASK_EXECUTOR must be gladius or docker")
 	}
 
-	if os.Getenv("FRAMEWORK_NAME") == "" {
-		log.Fatal("FRAMEWORK_NAME must be set")
+	executorScope = buildExecutorScope
+
+	if os.Getenv("EXECUTOR_SCOPE") != "" {
+		executorScope = os.Getenv("EXECUTOR_SCOPE")
 	}
 
-	if os.Getenv("GLADIUS_PORT") == "" {
-		log.Fatal("GLADIUS_PORT must be set")
+	if executorScope != buildExecutorScope && executorScope != taskExecutorScope {
+		log.Fatal("EXECUTOR_SCOPE must be build or task")
 	}
 
-	if os.Getenv("MEMORY_PER_TASK") == "" {
-		log.Fatal("MEMORY_PER_TASK must be set")
+	// The framework is only needed to run tasks on Mesos, and the executor
+	// only when tasks are not run by the Docker containerizer.
+	if os.Getenv("RUNNER") != "docker" {
+		if taskExecutor == gladiusTaskExecutor && os.Getenv("EXECUTOR_COMMAND") == "" {
+			log.Fatal("EXECUTOR_COMMAND must be set")
+		}
+
+		if taskExecutor == gladiusTaskExecutor && os.Getenv("EXECUTOR_ID") == "" {
+			log.Fatal("EXECUTOR_ID must be set")
+		}
+
+		if os.Getenv("FRAMEWORK_NAME") == "" {
+			log.Fatal("FRAMEWORK_NAME must be set")
+		}
 	}
 
-	if os.Getenv("REDIS_IDLE_TIMEOUT") == "" {
-		log.Fatal("REDIS_IDLE_TIMEOUT must be set")
+	if os.Getenv("GLADIUS_PORT") == "" {
+		log.Fatal("GLADIUS_PORT must be set")
 	}
 
-	if os.Getenv("REDIS_MAX_IDLE") == "" {
-		log.Fatal("REDIS_MAX_IDLE must be set")
+	if os.Getenv("MEMORY_PER_TASK") == "" {
+		log.Fatal("MEMORY_PER_TASK must be set")
 	}
 
 	quit = make(chan bool)
-	tasks = make(chan *Task)
+	queue = NewTaskQueue()
 	cpusPerTask, cpusParseErr = strconv.ParseFloat(os.Getenv("CPUS_PER_TASK"), 64)
 
 	if os.Getenv("DOCKER_TLS") == "1" {
@@ -84,31 +111,71 @@ func init() {
 	executorCommand = os.Getenv("EXECUTOR_COMMAND")
 	executorId = os.Getenv("EXECUTOR_ID")
 	frameworkName = os.Getenv("FRAMEWORK_NAME")
+	frameworkRole = defaultRole
+
+	if os.Getenv("FRAMEWORK_ROLE") != "" {
+		frameworkRole = os.Getenv("FRAMEWORK_ROLE")
+	}
+
 	gladiusPort = os.Getenv("GLADIUS_PORT")
 	memoryPerTask, memoryParseErr = strconv.ParseFloat(os.Getenv("MEMORY_PER_TASK"), 64)
-	redisPool = NewRedisPool()
+
+	if os.Getenv("DISK_PER_TASK") != "" {
+		diskPerTask, diskParseErr = strconv.ParseFloat(os.Getenv("DISK_PER_TASK"), 64)
+	}
+
+	taskMaxAttempts = 3
+
+	if os.Getenv("TASK_MAX_ATTEMPTS") != "" {
+		taskMaxAttempts, attemptsParseErr = strconv.Atoi(os.Getenv("TASK_MAX_ATTEMPTS"))
+	}
+
+	store, storeErr = NewBuildStore()
+
+	// The runner reads the framework id from the store.
+	if storeErr != nil {
+		log.Fatal("Failed to initialize the build store: ", storeErr)
+	}
+
 	routes = NewRoutes()
-	schedulerDriver, schedulerDriverErr = NewSchedulerDriver()
+	runningBuilds = NewBuildRegistry()
+	runner, runnerErr = NewRunner()
 
 	if dockerCliErr != nil {
 		log.Fatal("Failed to initialize Docker: ", dockerCliErr)
 	}
 
 	if cpusParseErr != nil {
-		log.Fatal("Failed to parse CPUS_PER_TASK: %v", cpusParseErr)
+		log.Fatalf("Failed to parse CPUS_PER_TASK: %v", cpusParseErr)
 	}
 
 	if memoryParseErr != nil {
-		log.Fatal("Failed to parse MEMORY_PER_TASK: %v", memoryParseErr)
+		log.Fatalf("Failed to parse MEMORY_PER_TASK: %v", memoryParseErr)
 	}
 
-	if schedulerDriverErr != nil {
-		log.Fatal("Failed to initialized scheduler driver: %s", schedulerDriverErr)
+	if diskParseErr != nil {
+		log.Fatalf("Failed to parse DISK_PER_TASK: %v", diskParseErr)
+	}
+
+	if attemptsParseErr != nil {
+		log.Fatalf("Failed to parse TASK_MAX_ATTEMPTS: %v", attemptsParseErr)
+	}
+
+	if runnerErr != nil {
+		log.Fatal("Failed to initialize the runner: ", runnerErr)
 	}
 
 	rand.Seed(time.Now().UTC().UnixNano())
+
+	err := resumeBuilds()
+
+	if err != nil {
+		log.Fatal("Failed to resume builds: ", err)
+	}
+
 	http.HandleFunc("/builds", routes.Builds)
 	http.HandleFunc("/builds/", routes.Builds)
+	http.HandleFunc("/queue", routes.Queue)
 
 	go func() {
 		err := http.ListenAndServe(fmt.Sprintf(":%s", gladiusPort), nil)
@@ -121,10 +188,10 @@ func init() {
 	}()
 
 	go func() {
-		stat, err := schedulerDriver.Run()
+		err := runner.Run()
 
 		if err != nil {
-			log.Printf("Framework stopped with status %s and error: %s\n", stat.String(), err.Error())
+			log.Printf("Runner stopped: %s", err.Error())
 
 			quit <- true
 		}
@@ -132,5 +199,7 @@ func init() {
 }
 
 func main() {
+	setup()
+
 	<-quit
 }
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	yaml "gopkg.in/yaml.v2"
+)
+
+const (
+	manifestFile = ".gladius.yml"
+)
+
+// Manifest describes how to test a repository: the image to run in, the
+// command preparing the checkout and the commands to run across the cluster.
+// It is read from the root of the cloned repository and can be supplied or
+// overridden inline when creating a build.
+type Manifest struct {
+	BaseImage   string          `json:"baseImage,omitempty" yaml:"baseImage"`
+	Setup       string          `json:"setup,omitempty" yaml:"setup"`
+	Constraints []string        `json:"constraints,omitempty" yaml:"constraints"`
+	TaskTimeout string          `json:"taskTimeout,omitempty" yaml:"taskTimeout"`
+	Tasks       []*ManifestTask `json:"tasks,omitempty" yaml:"tasks"`
+}
+
+type ManifestTask struct {
+	Cmd           string   `json:"cmd,omitempty" yaml:"cmd"`
+	Cpus          float64  `json:"cpus,omitempty" yaml:"cpus"`
+	Mem           float64  `json:"mem,omitempty" yaml:"mem"`
+	Disk          float64  `json:"disk,omitempty" yaml:"disk"`
+	Ports         int      `json:"ports,omitempty" yaml:"ports"`
+	MaxAttempts   int      `json:"maxAttempts,omitempty" yaml:"maxAttempts"`
+	RetryFailures bool     `json:"retryFailures,omitempty" yaml:"retryFailures"`
+	Constraints   []string `json:"constraints,omitempty" yaml:"constraints"`
+	Timeout       string   `json:"timeout,omitempty" yaml:"timeout"`
+}
+
+func ParseManifest(data []byte) (*Manifest, error) {
+	var m Manifest
+
+	err := yaml.Unmarshal(data, &m)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &m, nil
+}
+
+// Merge returns a new manifest where every field set in the override takes
+// precedence over the receiver's. Either side may be nil.
+func (m *Manifest) Merge(override *Manifest) *Manifest {
+	merged := &Manifest{}
+
+	if m != nil {
+		*merged = *m
+	}
+
+	if override == nil {
+		return merged
+	}
+
+	if override.BaseImage != "" {
+		merged.BaseImage = override.BaseImage
+	}
+
+	if override.Setup != "" {
+		merged.Setup = override.Setup
+	}
+
+	if len(override.Constraints) != 0 {
+		merged.Constraints = override.Constraints
+	}
+
+	if override.TaskTimeout != "" {
+		merged.TaskTimeout = override.TaskTimeout
+	}
+
+	if len(override.Tasks) != 0 {
+		merged.Tasks = override.Tasks
+	}
+
+	return merged
+}
+
+func (m *Manifest) Validate() error {
+	if len(m.Tasks) == 0 {
+		return errors.New("Manifest does not declare any tasks")
+	}
+
+	err := validateConstraints(m.Constraints)
+
+	if err != nil {
+		return err
+	}
+
+	err = validateTimeout(m.TaskTimeout)
+
+	if err != nil {
+		return err
+	}
+
+	for index, task := range m.Tasks {
+		if task.Cmd == "" {
+			return fmt.Errorf("Manifest task %d does not declare a cmd", index)
+		}
+
+		if task.Cpus < 0 || task.Mem < 0 || task.Disk < 0 || task.Ports < 0 {
+			return fmt.Errorf("Manifest task %d declares negative resources", index)
+		}
+
+		err := validateConstraints(task.Constraints)
+
+		if err == nil {
+			err = validateTimeout(task.Timeout)
+		}
+
+		if err != nil {
+			return fmt.Errorf("Manifest task %d: %v", index, err)
+		}
+	}
+
+	return nil
+}
+
+func validateConstraints(constraints []string) error {
+	for _, s := range constraints {
+		_, err := ParseConstraint(s)
+
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func validateTimeout(timeout string) error {
+	if timeout == "" {
+		return nil
+	}
+
+	duration, err := time.ParseDuration(timeout)
+
+	if err != nil || duration <= 0 {
+		return fmt.Errorf("Timeout %q is not a positive duration such as 20m", timeout)
+	}
+
+	return nil
+}
+
+// NewTasks creates a task for every command in the manifest, falling back to
+// the global resource defaults where a task does not declare its own. Each
+// task is bound by the manifest's constraints as well as its own.
+func (m *Manifest) NewTasks() []*Task {
+	tasks := []*Task{}
+
+	for _, mt := range m.Tasks {
+		task := NewTask(mt.Cmd)
+
+		if mt.Cpus != 0 {
+			task.Cpus = mt.Cpus
+		}
+
+		if mt.Mem != 0 {
+			task.Mem = mt.Mem
+		}
+
+		if mt.Disk != 0 {
+			task.Disk = mt.Disk
+		}
+
+		task.Ports = mt.Ports
+
+		if mt.MaxAttempts != 0 {
+			task.MaxAttempts = mt.MaxAttempts
+		}
+
+		task.RetryFailures = mt.RetryFailures
+		task.Constraints = append(append([]string{}, m.Constraints...), mt.Constraints...)
+		task.Timeout = m.TaskTimeout
+
+		if mt.Timeout != "" {
+			task.Timeout = mt.Timeout
+		}
+
+		tasks = append(tasks, task)
+	}
+
+	return tasks
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestManifestMerge(t *testing.T) {
+	repo := &Manifest{
+		BaseImage:   "ruby:2.2",
+		Setup:       "bundle install",
+		Constraints: []string{"rack:a"},
+		Tasks:       []*ManifestTask{{Cmd: "rake spec"}},
+	}
+	inline := &Manifest{
+		Setup:       "bundle install --deployment",
+		TaskTimeout: "20m",
+	}
+
+	tests := []struct {
+		name     string
+		manifest *Manifest
+		override *Manifest
+		want     Manifest
+	}{
+		{
+			name:     "defaults kept where not overridden",
+			manifest: repo,
+			override: inline,
+			want: Manifest{
+				BaseImage:   "ruby:2.2",
+				Setup:       "bundle install --deployment",
+				Constraints: []string{"rack:a"},
+				TaskTimeout: "20m",
+				Tasks:       repo.Tasks,
+			},
+		},
+		{
+			name:     "no override",
+			manifest: repo,
+			want:     *repo,
+		},
+		{
+			name:     "no manifest in the repository",
+			override: inline,
+			want:     *inline,
+		},
+	}
+
+	for _, test := range tests {
+		merged := test.manifest.Merge(test.override)
+
+		if merged.BaseImage != test.want.BaseImage ||
+			merged.Setup != test.want.Setup ||
+			merged.TaskTimeout != test.want.TaskTimeout ||
+			len(merged.Constraints) != len(test.want.Constraints) ||
+			len(merged.Tasks) != len(test.want.Tasks) {
+			t.Errorf("%s: merged %+v, want %+v", test.name, merged, test.want)
+		}
+	}
+}
+
+func TestManifestValidate(t *testing.T) {
+	tests := []struct {
+		name  string
+		data  string
+		valid bool
+	}{
+		{
+			name:  "valid",
+			data:  "tasks:\n- cmd: rake spec\n  timeout: 5m\n",
+			valid: true,
+		},
+		{
+			name:  "no tasks",
+			data:  "baseImage: ruby:2.2\n",
+			valid: false,
+		},
+		{
+			name:  "task missing its command",
+			data:  "tasks:\n- cmd: rake spec\n- cpus: 2\n",
+			valid: false,
+		},
+		{
+			name:  "negative resources",
+			data:  "tasks:\n- cmd: rake spec\n  mem: -1\n",
+			valid: false,
+		},
+		{
+			name:  "invalid timeout",
+			data:  "taskTimeout: soon\ntasks:\n- cmd: rake spec\n",
+			valid: false,
+		},
+		{
+			name:  "invalid constraint",
+			data:  "tasks:\n- cmd: rake spec\n  constraints: [rack]\n",
+			valid: false,
+		},
+	}
+
+	for _, test := range tests {
+		m, err := ParseManifest([]byte(test.data))
+
+		if err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+
+		err = m.Validate()
+
+		if (err == nil) != test.valid {
+			t.Errorf("%s: validated with %v, want valid %v", test.name, err, test.valid)
+		}
+	}
+}
+
+func TestManifestNewTasks(t *testing.T) {
+	cpusPerTask, memoryPerTask, diskPerTask, taskMaxAttempts = 1, 512, 0, 3
+
+	m := &Manifest{
+		Constraints: []string{"rack:a"},
+		TaskTimeout: "20m",
+		Tasks: []*ManifestTask{
+			{Cmd: "rake spec"},
+			{Cmd: "rake features", Cpus: 2, Mem: 1024, Disk: 100, Ports: 1, MaxAttempts: 1, RetryFailures: true, Constraints: []string{"unique_host"}, Timeout: "5m"},
+		},
+	}
+
+	tests := []struct {
+		name string
+		want Task
+	}{
+		{
+			name: "defaults",
+			want: Task{Cmd: "rake spec", Cpus: 1, Mem: 512, MaxAttempts: 3, Constraints: []string{"rack:a"}, Timeout: "20m"},
+		},
+		{
+			name: "overrides",
+			want: Task{Cmd: "rake features", Cpus: 2, Mem: 1024, Disk: 100, Ports: 1, MaxAttempts: 1, RetryFailures: true, Constraints: []string{"rack:a", "unique_host"}, Timeout: "5m"},
+		},
+	}
+
+	tasks := m.NewTasks()
+
+	if len(tasks) != len(tests) {
+		t.Fatalf("created %d tasks, want %d", len(tasks), len(tests))
+	}
+
+	for i, test := range tests {
+		task := tasks[i]
+
+		if task.Cmd != test.want.Cmd ||
+			task.Cpus != test.want.Cpus ||
+			task.Mem != test.want.Mem ||
+			task.Disk != test.want.Disk ||
+			task.Ports != test.want.Ports ||
+			task.MaxAttempts != test.want.MaxAttempts ||
+			task.RetryFailures != test.want.RetryFailures ||
+			task.Timeout != test.want.Timeout ||
+			strings.Join(task.Constraints, ",") != strings.Join(test.want.Constraints, ",") {
+			t.Errorf("%s: created %+v, want %+v", test.name, task, test.want)
+		}
+	}
+}
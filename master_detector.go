@@ -0,0 +1,173 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"sync"
+
+	"github.com/mesos/mesos-go/detector"
+	_ "github.com/mesos/mesos-go/detector/zoo"
+	mesos "github.com/mesos/mesos-go/mesosproto"
+)
+
+const (
+	// The driver picks a detector by the prefix of the master spec, so a
+	// list of masters is handed to it behind a prefix of its own.
+	masterListPrefix = "masters://"
+)
+
+func init() {
+	err := detector.Register(masterListPrefix, detector.PluginFactory(func(spec string) (detector.Master, error) {
+		return NewMasterListDetector(strings.TrimPrefix(spec, masterListPrefix))
+	}))
+
+	if err != nil {
+		panic(err)
+	}
+}
+
+// masterSpec turns the MASTER setting into what the driver detects the leading
+// master with: a zk:// URL is left as it is, and a comma-separated list of
+// masters is followed by a MasterListDetector.
+func masterSpec(master string) string {
+	if strings.HasPrefix(master, "zk://") || !strings.Contains(master, ",") {
+		return master
+	}
+
+	return masterListPrefix + master
+}
+
+// MasterListDetector follows the leading master through every master of a
+// list. Each master is polled for the leader it knows of, so the leader is
+// still found while some of the masters are down.
+type MasterListDetector struct {
+	masters    []detector.Master
+	done       chan struct{}
+	cancelOnce sync.Once
+}
+
+type reportedMaster struct {
+	index  int
+	leader *mesos.MasterInfo
+}
+
+func NewMasterListDetector(list string) (*MasterListDetector, error) {
+	d := &MasterListDetector{
+		done: make(chan struct{}),
+	}
+
+	for _, address := range strings.Split(list, ",") {
+		address = strings.TrimSpace(address)
+
+		if address == "" {
+			continue
+		}
+
+		master, err := detector.New(address)
+
+		if err != nil {
+			return nil, err
+		}
+
+		d.masters = append(d.masters, master)
+	}
+
+	if len(d.masters) == 0 {
+		return nil, detector.EmptySpecError
+	}
+
+	return d, nil
+}
+
+func (d *MasterListDetector) Detect(o detector.MasterChanged) error {
+	if o == nil {
+		return errors.New("Cannot detect masters without a listener")
+	}
+
+	reports := make(chan reportedMaster)
+
+	for index, master := range d.masters {
+		index := index
+
+		err := master.Detect(detector.OnMasterChanged(func(leader *mesos.MasterInfo) {
+			select {
+			case reports <- reportedMaster{index, leader}:
+			case <-d.done:
+			}
+		}))
+
+		if err != nil {
+			d.Cancel()
+
+			return err
+		}
+	}
+
+	go d.follow(reports, o)
+
+	return nil
+}
+
+// follow tells the listener of the leader most recently reported by any master
+// of the list, whenever it changes. A master that goes down does not always
+// report losing the leader, so an earlier report is never preferred over a
+// later one, and a master reporting no leader falls back to the others.
+func (d *MasterListDetector) follow(reports chan reportedMaster, o detector.MasterChanged) {
+	leaders := make([]*mesos.MasterInfo, len(d.masters))
+	reportedAt := make([]int, len(d.masters))
+	reported := 0
+
+	var current *mesos.MasterInfo
+
+	for {
+		select {
+		case report := <-reports:
+			reported++
+			leaders[report.index] = report.leader
+			reportedAt[report.index] = reported
+
+			var leader *mesos.MasterInfo
+
+			latest := 0
+
+			for i, l := range leaders {
+				if l != nil && reportedAt[i] > latest {
+					leader = l
+					latest = reportedAt[i]
+				}
+			}
+
+			if sameMaster(leader, current) {
+				continue
+			}
+
+			current = leader
+
+			o.OnMasterChanged(leader)
+		case <-d.done:
+			return
+		}
+	}
+}
+
+func sameMaster(a *mesos.MasterInfo, b *mesos.MasterInfo) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+
+	return a.GetId() == b.GetId() && a.GetIp() == b.GetIp() && a.GetPort() == b.GetPort()
+}
+
+func (d *MasterListDetector) Done() <-chan struct{} {
+	return d.done
+}
+
+func (d *MasterListDetector) Cancel() {
+	d.cancelOnce.Do(func() {
+		close(d.done)
+
+		for _, master := range d.masters {
+			master.Cancel()
+		}
+	})
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	proto "github.com/gogo/protobuf/proto"
+	"github.com/mesos/mesos-go/detector"
+	mesos "github.com/mesos/mesos-go/mesosproto"
+)
+
+// fakeMaster stands in for the detector polling one master of a list.
+type fakeMaster struct {
+	listener detector.MasterChanged
+	done     chan struct{}
+}
+
+func (m *fakeMaster) Detect(o detector.MasterChanged) error {
+	m.listener = o
+
+	return nil
+}
+
+func (m *fakeMaster) Done() <-chan struct{} {
+	return m.done
+}
+
+func (m *fakeMaster) Cancel() {
+}
+
+type masterReport struct {
+	master int
+	leader string
+}
+
+func masterInfo(id string) *mesos.MasterInfo {
+	if id == "" {
+		return nil
+	}
+
+	return &mesos.MasterInfo{
+		Id:   proto.String(id),
+		Ip:   proto.Uint32(1),
+		Port: proto.Uint32(5050),
+	}
+}
+
+func TestMasterListDetectorFollowsLeader(t *testing.T) {
+	tests := []struct {
+		name    string
+		reports []masterReport
+		changes []string
+	}{
+		{
+			name:    "masters agreeing on the leader",
+			reports: []masterReport{{0, "a"}, {1, "a"}, {2, "a"}},
+			changes: []string{"a"},
+		},
+		{
+			name:    "leader down without reporting it",
+			reports: []masterReport{{0, "a"}, {1, "a"}, {1, "b"}, {2, "b"}, {2, "c"}},
+			changes: []string{"a", "b", "c"},
+		},
+		{
+			name:    "master losing the leader falls back to the others",
+			reports: []masterReport{{0, "a"}, {1, "a"}, {0, ""}, {1, "b"}},
+			changes: []string{"a", "b"},
+		},
+		{
+			name:    "every master losing the leader",
+			reports: []masterReport{{0, "a"}, {1, "a"}, {0, ""}, {1, ""}},
+			changes: []string{"a", ""},
+		},
+	}
+
+	for _, test := range tests {
+		masters := []*fakeMaster{}
+		d := &MasterListDetector{done: make(chan struct{})}
+
+		for i := 0; i < 3; i++ {
+			master := &fakeMaster{done: make(chan struct{})}
+			masters = append(masters, master)
+			d.masters = append(d.masters, master)
+		}
+
+		changed := make(chan string, len(test.reports))
+
+		err := d.Detect(detector.OnMasterChanged(func(leader *mesos.MasterInfo) {
+			changed <- leader.GetId()
+		}))
+
+		if err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+
+		for _, report := range test.reports {
+			masters[report.master].listener.OnMasterChanged(masterInfo(report.leader))
+		}
+
+		changes := []string{}
+
+		for len(changes) < len(test.changes) {
+			select {
+			case leader := <-changed:
+				changes = append(changes, leader)
+			case <-time.After(time.Second):
+				t.Fatalf("%s: changed to %v, want %v", test.name, changes, test.changes)
+			}
+		}
+
+		d.Cancel()
+
+		if !reflect.DeepEqual(changes, test.changes) {
+			t.Errorf("%s: changed to %v, want %v", test.name, changes, test.changes)
+		}
+	}
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"encoding/json"
+	"sync"
+)
+
+// MemoryStore keeps builds and logs in this process only. It suits tests and
+// single node development, where losing every build on restart is fine.
+type MemoryStore struct {
+	mutex       sync.Mutex
+	builds      map[string][]byte
+	order       []string
+	logs        map[string][]string
+	frameworkId string
+	broadcaster *logBroadcaster
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		builds:      make(map[string][]byte),
+		order:       []string{},
+		logs:        make(map[string][]string),
+		broadcaster: newLogBroadcaster(),
+	}
+}
+
+func (s *MemoryStore) CreateBuild(b *Build) error {
+	err := s.SaveBuild(b)
+
+	if err != nil {
+		return err
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.order = append(s.order, b.Id)
+
+	return nil
+}
+
+// SaveBuild keeps the build as JSON, so later changes to the build are only
+// seen once it is saved again, as with the other stores.
+func (s *MemoryStore) SaveBuild(b *Build) error {
+	buildJson, err := json.Marshal(b)
+
+	if err != nil {
+		return err
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.builds[b.Id] = buildJson
+
+	return nil
+}
+
+func (s *MemoryStore) GetBuild(id string) (*Build, error) {
+	var build Build
+
+	s.mutex.Lock()
+	buildJson, ok := s.builds[id]
+	s.mutex.Unlock()
+
+	if !ok {
+		return nil, errBuildNotFound
+	}
+
+	err := json.Unmarshal(buildJson, &build)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &build, nil
+}
+
+func (s *MemoryStore) ListBuilds(limit int) ([]*Build, error) {
+	builds := []*Build{}
+
+	s.mutex.Lock()
+	ids := make([]string, len(s.order))
+	copy(ids, s.order)
+	s.mutex.Unlock()
+
+	for i := len(ids) - 1; i >= 0 && len(builds) < limit; i-- {
+		build, err := s.GetBuild(ids[i])
+
+		if err != nil {
+			return nil, err
+		}
+
+		builds = append(builds, build)
+	}
+
+	return builds, nil
+}
+
+func (s *MemoryStore) ListUnfinishedBuilds() ([]*Build, error) {
+	builds := []*Build{}
+
+	s.mutex.Lock()
+	ids := make([]string, len(s.order))
+	copy(ids, s.order)
+	s.mutex.Unlock()
+
+	for _, id := range ids {
+		build, err := s.GetBuild(id)
+
+		if err != nil {
+			return nil, err
+		}
+
+		if !build.State.IsTerminal() {
+			builds = append(builds, build)
+		}
+	}
+
+	return builds, nil
+}
+
+func (s *MemoryStore) AppendLog(buildId string, taskId string, line string) error {
+	name := logName(buildId, taskId)
+
+	s.mutex.Lock()
+	s.logs[name] = append(s.logs[name], line)
+	index := len(s.logs[name]) - 1
+	s.mutex.Unlock()
+
+	s.broadcaster.publish(name, LogLine{index, line})
+
+	return nil
+}
+
+func (s *MemoryStore) ReadLog(buildId string, taskId string, start int) ([]string, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	lines := s.logs[logName(buildId, taskId)]
+
+	if start >= len(lines) {
+		return []string{}, nil
+	}
+
+	return append([]string{}, lines[start:]...), nil
+}
+
+func (s *MemoryStore) SubscribeLog(buildId string, taskId string, done <-chan bool) (<-chan LogLine, error) {
+	return s.broadcaster.subscribe(logName(buildId, taskId), done), nil
+}
+
+func (s *MemoryStore) FrameworkId() (string, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return s.frameworkId, nil
+}
+
+func (s *MemoryStore) SaveFrameworkId(id string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.frameworkId = id
+
+	return nil
+}
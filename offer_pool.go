@@ -0,0 +1,130 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	mesos "github.com/mesos/mesos-go/mesosproto"
+)
+
+// OfferPool holds the offers Gladius has neither used nor declined yet. An
+// offer is taken out of the pool while tasks are matched with it, and put back
+// if none fit, unless it was rescinded in the meantime.
+type OfferPool struct {
+	mutex     sync.Mutex
+	offers    map[string]*heldOffer
+	taken     map[string]bool
+	rescinded map[string]bool
+}
+
+type heldOffer struct {
+	offer  *mesos.Offer
+	heldAt time.Time
+}
+
+func NewOfferPool() *OfferPool {
+	return &OfferPool{
+		offers:    make(map[string]*heldOffer),
+		taken:     make(map[string]bool),
+		rescinded: make(map[string]bool),
+	}
+}
+
+func (p *OfferPool) Add(offer *mesos.Offer) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	p.offers[offer.Id.GetValue()] = &heldOffer{
+		offer:  offer,
+		heldAt: time.Now(),
+	}
+}
+
+// Rescind forgets an offer, or marks it as rescinded if it has been taken.
+func (p *OfferPool) Rescind(id string) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	delete(p.offers, id)
+
+	if p.taken[id] {
+		p.rescinded[id] = true
+	}
+}
+
+// TakeAll takes every held offer out of the pool.
+func (p *OfferPool) TakeAll() []*heldOffer {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	held := []*heldOffer{}
+
+	for id, offer := range p.offers {
+		held = append(held, offer)
+		p.taken[id] = true
+
+		delete(p.offers, id)
+	}
+
+	return held
+}
+
+// Return puts a taken offer back in the pool, unless it was rescinded.
+func (p *OfferPool) Return(held *heldOffer) {
+	id := held.offer.Id.GetValue()
+
+	if p.Done(id) {
+		return
+	}
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	p.offers[id] = held
+}
+
+// Done forgets a taken offer, reporting whether it was rescinded while it
+// was taken.
+func (p *OfferPool) Done(id string) bool {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	rescinded := p.rescinded[id]
+
+	delete(p.taken, id)
+	delete(p.rescinded, id)
+
+	return rescinded
+}
+
+// Clear forgets every held offer, and any taken offer as if rescinded.
+func (p *OfferPool) Clear() {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	p.offers = make(map[string]*heldOffer)
+
+	for id := range p.taken {
+		p.rescinded[id] = true
+	}
+}
+
+// Expire takes the offers held for longer than the timeout out of the pool.
+func (p *OfferPool) Expire(timeout time.Duration) []*mesos.Offer {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	expired := []*mesos.Offer{}
+
+	for id, held := range p.offers {
+		if time.Since(held.heldAt) < timeout {
+			continue
+		}
+
+		expired = append(expired, held.offer)
+
+		delete(p.offers, id)
+	}
+
+	return expired
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	proto "github.com/gogo/protobuf/proto"
+	mesos "github.com/mesos/mesos-go/mesosproto"
+	util "github.com/mesos/mesos-go/mesosutil"
+)
+
+const (
+	defaultRole = "*"
+)
+
+// offerResources is what is left of an offer as tasks are packed into it.
+// Resources reserved for the framework's role are used before unreserved ones.
+type offerResources struct {
+	roles []*roleResources
+}
+
+type roleResources struct {
+	role  string
+	cpus  float64
+	mem   float64
+	disk  float64
+	ports []uint64
+}
+
+func newOfferResources(offer *mesos.Offer) *offerResources {
+	r := &offerResources{}
+	roles := make(map[string]*roleResources)
+
+	for _, role := range []string{frameworkRole, defaultRole} {
+		if roles[role] == nil {
+			roles[role] = &roleResources{role: role, ports: []uint64{}}
+			r.roles = append(r.roles, roles[role])
+		}
+	}
+
+	for _, res := range offer.Resources {
+		role := roles[res.GetRole()]
+
+		if role == nil {
+			continue
+		}
+
+		switch res.GetName() {
+		case "cpus":
+			role.cpus += res.GetScalar().GetValue()
+		case "mem":
+			role.mem += res.GetScalar().GetValue()
+		case "disk":
+			role.disk += res.GetScalar().GetValue()
+		case "ports":
+			for _, portRange := range res.GetRanges().GetRange() {
+				for port := portRange.GetBegin(); port <= portRange.GetEnd(); port++ {
+					role.ports = append(role.ports, port)
+				}
+			}
+		}
+	}
+
+	return r
+}
+
+func (r *offerResources) fits(task *Task) bool {
+	cpus, mem, disk, ports := 0.0, 0.0, 0.0, 0
+
+	for _, role := range r.roles {
+		cpus += role.cpus
+		mem += role.mem
+		disk += role.disk
+		ports += len(role.ports)
+	}
+
+	return cpus >= task.Cpus && mem >= task.Mem && disk >= task.Disk && ports >= task.Ports
+}
+
+// take sets aside the resources of a task that fits, returning them as they
+// are to be launched with and the ports allocated to the task.
+func (r *offerResources) take(task *Task) ([]*mesos.Resource, []uint64) {
+	resources := []*mesos.Resource{}
+	ports := []uint64{}
+	cpus, mem, disk, portCount := task.Cpus, task.Mem, task.Disk, task.Ports
+
+	for _, role := range r.roles {
+		resources = append(resources, takeScalar(role, "cpus", &role.cpus, &cpus)...)
+		resources = append(resources, takeScalar(role, "mem", &role.mem, &mem)...)
+		resources = append(resources, takeScalar(role, "disk", &role.disk, &disk)...)
+
+		count := portCount
+
+		if count > len(role.ports) {
+			count = len(role.ports)
+		}
+
+		if count == 0 {
+			continue
+		}
+
+		ranges := []*mesos.Value_Range{}
+
+		for _, port := range role.ports[:count] {
+			ranges = append(ranges, util.NewValueRange(port, port))
+		}
+
+		ports = append(ports, role.ports[:count]...)
+		role.ports = role.ports[count:]
+		portCount -= count
+		resource := util.NewRangesResource("ports", ranges)
+		resource.Role = proto.String(role.role)
+		resources = append(resources, resource)
+	}
+
+	return resources, ports
+}
+
+// takeScalar takes as much of what is still needed as the role has left.
+func takeScalar(role *roleResources, name string, available *float64, needed *float64) []*mesos.Resource {
+	amount := *needed
+
+	if amount > *available {
+		amount = *available
+	}
+
+	if amount <= 0 {
+		return nil
+	}
+
+	*available -= amount
+	*needed -= amount
+	resource := util.NewScalarResource(name, amount)
+	resource.Role = proto.String(role.role)
+
+	return []*mesos.Resource{resource}
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+
+	proto "github.com/gogo/protobuf/proto"
+	mesos "github.com/mesos/mesos-go/mesosproto"
+	util "github.com/mesos/mesos-go/mesosutil"
+)
+
+func roleResource(role string, resource *mesos.Resource) *mesos.Resource {
+	resource.Role = proto.String(role)
+
+	return resource
+}
+
+// mixedRoleOffer offers resources reserved for the framework's role, for no
+// role and for another framework's role.
+func mixedRoleOffer() *mesos.Offer {
+	return &mesos.Offer{
+		Resources: []*mesos.Resource{
+			roleResource("ci", util.NewScalarResource("cpus", 1)),
+			util.NewScalarResource("cpus", 2),
+			roleResource("other", util.NewScalarResource("cpus", 8)),
+			roleResource("ci", util.NewScalarResource("mem", 512)),
+			util.NewScalarResource("mem", 1024),
+			roleResource("ci", util.NewRangesResource("ports", []*mesos.Value_Range{util.NewValueRange(31000, 31001)})),
+			util.NewRangesResource("ports", []*mesos.Value_Range{util.NewValueRange(32000, 32000)}),
+			roleResource("other", util.NewRangesResource("ports", []*mesos.Value_Range{util.NewValueRange(33000, 33099)})),
+		},
+	}
+}
+
+// describeResources writes resources as role:name=value for comparison.
+func describeResources(resources []*mesos.Resource) []string {
+	described := []string{}
+
+	for _, resource := range resources {
+		value := fmt.Sprint(resource.GetScalar().GetValue())
+
+		if resource.GetType() == mesos.Value_RANGES {
+			ranges := []string{}
+
+			for _, r := range resource.GetRanges().GetRange() {
+				ranges = append(ranges, fmt.Sprintf("%d-%d", r.GetBegin(), r.GetEnd()))
+			}
+
+			value = strings.Join(ranges, ",")
+		}
+
+		described = append(described, fmt.Sprintf("%s:%s=%s", resource.GetRole(), resource.GetName(), value))
+	}
+
+	return described
+}
+
+func TestOfferResourcesFits(t *testing.T) {
+	frameworkRole = "ci"
+
+	tests := []struct {
+		name string
+		task *Task
+		fits bool
+	}{
+		{"framework and unreserved cpus", &Task{Cpus: 3, Mem: 1536}, true},
+		{"cpus of another role", &Task{Cpus: 3.5}, false},
+		{"too much mem", &Task{Cpus: 1, Mem: 2048}, false},
+		{"framework and unreserved ports", &Task{Ports: 3}, true},
+		{"ports of another role", &Task{Ports: 4}, false},
+		{"disk not offered", &Task{Disk: 1}, false},
+	}
+
+	for _, test := range tests {
+		if newOfferResources(mixedRoleOffer()).fits(test.task) != test.fits {
+			t.Errorf("%s: fits %v, want %v", test.name, !test.fits, test.fits)
+		}
+	}
+}
+
+func TestOfferResourcesTake(t *testing.T) {
+	frameworkRole = "ci"
+	resources := newOfferResources(mixedRoleOffer())
+
+	tests := []struct {
+		name      string
+		task      *Task
+		resources []string
+		ports     []uint64
+	}{
+		{
+			name:      "framework role first",
+			task:      &Task{Cpus: 0.5, Mem: 256, Ports: 1},
+			resources: []string{"ci:cpus=0.5", "ci:mem=256", "ci:ports=31000-31000"},
+			ports:     []uint64{31000},
+		},
+		{
+			name:      "split across roles",
+			task:      &Task{Cpus: 1, Mem: 512, Ports: 2},
+			resources: []string{"ci:cpus=0.5", "ci:mem=256", "ci:ports=31001-31001", "*:cpus=0.5", "*:mem=256", "*:ports=32000-32000"},
+			ports:     []uint64{31001, 32000},
+		},
+		{
+			name:      "unreserved only once the role is used up",
+			task:      &Task{Cpus: 1.5, Mem: 768},
+			resources: []string{"*:cpus=1.5", "*:mem=768"},
+			ports:     []uint64{},
+		},
+	}
+
+	for _, test := range tests {
+		if !resources.fits(test.task) {
+			t.Fatalf("%s: does not fit", test.name)
+		}
+
+		taken, ports := resources.take(test.task)
+
+		if !reflect.DeepEqual(describeResources(taken), test.resources) {
+			t.Errorf("%s: took %v, want %v", test.name, describeResources(taken), test.resources)
+		}
+
+		if !reflect.DeepEqual(ports, test.ports) {
+			t.Errorf("%s: took ports %v, want %v", test.name, ports, test.ports)
+		}
+	}
+
+	if resources.fits(&Task{Ports: 1}) {
+		t.Errorf("fits a port once every port is taken")
+	}
+
+	if resources.fits(&Task{Cpus: 0.1}) {
+		t.Errorf("fits cpus once every cpu is taken")
+	}
+
+	if !resources.fits(&Task{}) {
+		t.Errorf("does not fit a task needing nothing")
+	}
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"log"
+	"time"
+
+	mesos "github.com/mesos/mesos-go/mesosproto"
+	util "github.com/mesos/mesos-go/mesosutil"
+	sched "github.com/mesos/mesos-go/scheduler"
+)
+
+const (
+	reconcileInterval    = 5 * time.Second
+	reconcileMaxInterval = 1 * time.Minute
+	reconcileMaxAttempts = 8
+)
+
+// reconcile learns the true state of the tasks launched before the master
+// last changed. Tasks believed to be running are reconciled explicitly, asking
+// again with a growing interval for those the master has not answered, then
+// the master is asked implicitly for any others it knows about. The answers
+// arrive as status updates like any other.
+//
+// A reconciliation started by a later registration supersedes this one.
+func (s *Scheduler) reconcile(driver sched.SchedulerDriver) {
+	statuses, err := launchedTaskStatuses()
+
+	if err != nil {
+		log.Printf("Could not find tasks to reconcile: %v", err)
+
+		return
+	}
+
+	s.mutex.Lock()
+	s.reconciliation++
+	reconciliation := s.reconciliation
+	s.reconciling = make(map[string]*mesos.TaskStatus)
+
+	for _, status := range statuses {
+		s.reconciling[status.TaskId.GetValue()] = status
+	}
+
+	s.mutex.Unlock()
+
+	interval := reconcileInterval
+
+	for attempt := 1; ; attempt++ {
+		pending, current := s.pendingReconciliation(reconciliation)
+
+		if !current {
+			return
+		}
+
+		if len(pending) == 0 {
+			break
+		}
+
+		if attempt > reconcileMaxAttempts {
+			log.Printf("Giving up on explicitly reconciling %d tasks", len(pending))
+
+			break
+		}
+
+		log.Printf("Reconciling %d tasks explicitly", len(pending))
+
+		_, err := driver.ReconcileTasks(pending)
+
+		if err != nil {
+			log.Printf("Could not reconcile tasks: %v", err)
+
+			return
+		}
+
+		time.Sleep(interval)
+
+		interval *= 2
+
+		if interval > reconcileMaxInterval {
+			interval = reconcileMaxInterval
+		}
+	}
+
+	if _, current := s.pendingReconciliation(reconciliation); !current {
+		return
+	}
+
+	log.Printf("Reconciling tasks implicitly")
+
+	_, err = driver.ReconcileTasks([]*mesos.TaskStatus{})
+
+	if err != nil {
+		log.Printf("Could not reconcile tasks: %v", err)
+	}
+}
+
+// pendingReconciliation returns the statuses of the tasks still awaiting an
+// answer, and whether the reconciliation is still the latest one.
+func (s *Scheduler) pendingReconciliation(reconciliation int) ([]*mesos.TaskStatus, bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if reconciliation != s.reconciliation {
+		return nil, false
+	}
+
+	pending := []*mesos.TaskStatus{}
+
+	for _, status := range s.reconciling {
+		pending = append(pending, status)
+	}
+
+	return pending, true
+}
+
+// reconciled notes that the master has answered for a task.
+func (s *Scheduler) reconciled(taskId string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	delete(s.reconciling, taskId)
+}
+
+// launchedTaskStatuses returns the last known status of the current attempt
+// of each launched task of the unfinished builds.
+func launchedTaskStatuses() ([]*mesos.TaskStatus, error) {
+	statuses := []*mesos.TaskStatus{}
+	builds, err := store.ListUnfinishedBuilds()
+
+	if err != nil {
+		return nil, err
+	}
+
+	for _, build := range builds {
+		// A build running in this process is more up to date than its
+		// last save.
+		if running := runningBuilds.Get(build.Id); running != nil {
+			build = running
+		}
+
+		build.mutex.Lock()
+
+		for _, task := range build.Tasks {
+			attempt := task.Attempt()
+
+			if attempt == nil || attempt.LaunchedAt == nil || task.IsTerminal() {
+				continue
+			}
+
+			status := &mesos.TaskStatus{
+				TaskId: util.NewTaskID(attempt.Id),
+				State:  mesos.TaskState_TASK_STAGING.Enum(),
+			}
+
+			if attempt.Status != nil {
+				status.State = attempt.Status.State
+				status.SlaveId = attempt.Status.SlaveId
+			}
+
+			statuses = append(statuses, status)
+		}
+
+		build.mutex.Unlock()
+	}
+
+	return statuses, nil
+}
@@ -0,0 +1,304 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+
+	redis "github.com/garyburd/redigo/redis"
+)
+
+const (
+	redisBuildsKey           = "pugio:builds"
+	redisUnfinishedBuildsKey = "pugio:builds:unfinished"
+	redisFrameworkIdKey      = "pugio:framework_id"
+)
+
+// RedisStore keeps each build as JSON under its own key, the builds as a list
+// in creation order, the ids of unfinished builds as a set, and each log as a
+// list whose appended lines are also published, prefixed with their index, on
+// a channel named after it.
+type RedisStore struct {
+	pool *redis.Pool
+}
+
+func NewRedisStore() *RedisStore {
+	return &RedisStore{
+		pool: NewRedisPool(),
+	}
+}
+
+func redisBuildKey(id string) string {
+	return fmt.Sprintf("%s:%s", redisBuildsKey, id)
+}
+
+func redisLogKey(buildId string, taskId string) string {
+	return fmt.Sprintf("pugio:%s:log", logName(buildId, taskId))
+}
+
+func (s *RedisStore) CreateBuild(b *Build) error {
+	conn := s.pool.Get()
+
+	defer conn.Close()
+
+	buildJson, err := json.Marshal(b)
+
+	if err != nil {
+		return err
+	}
+
+	_, err = conn.Do("SET", redisBuildKey(b.Id), buildJson)
+
+	if err != nil {
+		return err
+	}
+
+	err = redisTrackUnfinished(conn, b)
+
+	if err != nil {
+		return err
+	}
+
+	_, err = conn.Do("LPUSH", redisBuildsKey, buildJson)
+
+	return err
+}
+
+func (s *RedisStore) SaveBuild(b *Build) error {
+	conn := s.pool.Get()
+
+	defer conn.Close()
+
+	buildJson, err := json.Marshal(b)
+
+	if err != nil {
+		return err
+	}
+
+	_, err = conn.Do("SET", redisBuildKey(b.Id), buildJson)
+
+	if err != nil {
+		return err
+	}
+
+	return redisTrackUnfinished(conn, b)
+}
+
+// redisTrackUnfinished keeps the build's id in the set of unfinished builds
+// until it reaches a terminal state.
+func redisTrackUnfinished(conn redis.Conn, b *Build) error {
+	command := "SADD"
+
+	if b.State.IsTerminal() {
+		command = "SREM"
+	}
+
+	_, err := conn.Do(command, redisUnfinishedBuildsKey, b.Id)
+
+	return err
+}
+
+func (s *RedisStore) GetBuild(id string) (*Build, error) {
+	var build Build
+
+	conn := s.pool.Get()
+
+	defer conn.Close()
+
+	bytes, err := redis.Bytes(conn.Do("GET", redisBuildKey(id)))
+
+	if err == redis.ErrNil {
+		return nil, errBuildNotFound
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	err = json.Unmarshal(bytes, &build)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &build, nil
+}
+
+func (s *RedisStore) ListBuilds(limit int) ([]*Build, error) {
+	conn := s.pool.Get()
+
+	defer conn.Close()
+
+	builds := []*Build{}
+	values, err := redis.Values(conn.Do("LRANGE", redisBuildsKey, 0, limit-1))
+
+	if err != nil {
+		return nil, err
+	}
+
+	for _, value := range values {
+		var listed Build
+
+		bytes, err := redis.Bytes(value, nil)
+
+		if err == nil {
+			err = json.Unmarshal(bytes, &listed)
+		}
+
+		if err != nil {
+			log.Print(err)
+
+			continue
+		}
+
+		// The list holds each build as it was created, so the latest
+		// copy is read to report its current state.
+		build, err := s.GetBuild(listed.Id)
+
+		if err != nil {
+			log.Print(err)
+
+			build = &listed
+		}
+
+		builds = append(builds, build)
+	}
+
+	return builds, nil
+}
+
+func (s *RedisStore) ListUnfinishedBuilds() ([]*Build, error) {
+	conn := s.pool.Get()
+
+	defer conn.Close()
+
+	builds := []*Build{}
+	ids, err := redis.Strings(conn.Do("SMEMBERS", redisUnfinishedBuildsKey))
+
+	if err != nil {
+		return nil, err
+	}
+
+	for _, id := range ids {
+		build, err := s.GetBuild(id)
+
+		if err != nil {
+			log.Print(err)
+
+			continue
+		}
+
+		builds = append(builds, build)
+	}
+
+	return builds, nil
+}
+
+func (s *RedisStore) AppendLog(buildId string, taskId string, line string) error {
+	conn := s.pool.Get()
+	key := redisLogKey(buildId, taskId)
+
+	defer conn.Close()
+
+	length, err := redis.Int(conn.Do("RPUSH", key, line))
+
+	if err != nil {
+		return err
+	}
+
+	_, err = conn.Do("PUBLISH", key, fmt.Sprintf("%d %s", length-1, line))
+
+	return err
+}
+
+func (s *RedisStore) ReadLog(buildId string, taskId string, start int) ([]string, error) {
+	conn := s.pool.Get()
+
+	defer conn.Close()
+
+	return redis.Strings(conn.Do("LRANGE", redisLogKey(buildId, taskId), start, -1))
+}
+
+func (s *RedisStore) SubscribeLog(buildId string, taskId string, done <-chan bool) (<-chan LogLine, error) {
+	// A subscribed connection cannot be returned to the pool, so each
+	// subscription dials its own.
+	conn, err := redisDial()
+
+	if err != nil {
+		return nil, err
+	}
+
+	pubSub := redis.PubSubConn{Conn: conn}
+	err = pubSub.Subscribe(redisLogKey(buildId, taskId))
+
+	if err != nil {
+		conn.Close()
+
+		return nil, err
+	}
+
+	lines := make(chan LogLine)
+
+	go func() {
+		<-done
+		conn.Close()
+	}()
+
+	go func() {
+		defer close(lines)
+
+		for {
+			switch message := pubSub.Receive().(type) {
+			case redis.Message:
+				parts := strings.SplitN(string(message.Data), " ", 2)
+				index, err := strconv.Atoi(parts[0])
+
+				if err != nil || len(parts) != 2 {
+					continue
+				}
+
+				select {
+				case lines <- LogLine{index, parts[1]}:
+				case <-done:
+					return
+				}
+			case error:
+				return
+			}
+		}
+	}()
+
+	return lines, nil
+}
+
+func (s *RedisStore) FrameworkId() (string, error) {
+	conn := s.pool.Get()
+
+	defer conn.Close()
+
+	id, err := redis.String(conn.Do("GET", redisFrameworkIdKey))
+
+	if err == redis.ErrNil {
+		return "", nil
+	}
+
+	return id, err
+}
+
+func (s *RedisStore) SaveFrameworkId(id string) error {
+	conn := s.pool.Get()
+
+	defer conn.Close()
+
+	if id == "" {
+		_, err := conn.Do("DEL", redisFrameworkIdKey)
+
+		return err
+	}
+
+	_, err := conn.Do("SET", redisFrameworkIdKey, id)
+
+	return err
+}
@@ -1,20 +1,27 @@
 package main
 
 import (
-	"bytes"
 	"encoding/json"
 	"io/ioutil"
 	"log"
 	"net/http"
 	//	"reflect"
 	"strings"
-
-	redis "github.com/garyburd/redigo/redis"
 )
 
 type Routes struct {
 }
 
+// buildRequest is what a client may set when creating a build; everything
+// else about a build is owned by Gladius.
+type buildRequest struct {
+	App       string    `json:"app"`
+	Branch    string    `json:"branch"`
+	BaseImage string    `json:"baseImage"`
+	Manifest  *Manifest `json:"manifest"`
+	Priority  int       `json:"priority"`
+}
+
 func NewRoutes() *Routes {
 	return &Routes{}
 }
@@ -30,119 +37,121 @@ func (r *Routes) Builds(w http.ResponseWriter, req *http.Request) {
 	w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
 	log.Printf("%s %s", req.Method, req.URL.Path)
 
-	conn := redisPool.Get()
-
-	defer conn.Close()
-
 	switch req.Method {
 	case "OPTIONS":
 		w.WriteHeader(http.StatusOK)
 
 		return
 	case "GET":
-		var keyBuffer bytes.Buffer
-
 		urlPath := strings.Split(req.URL.Path, "/")
 
-		keyBuffer.WriteString("pugio:builds")
-
 		switch len(urlPath) {
 		case 2:
-			builds := []*Build{}
-			values, _ := redis.Values(conn.Do("LRANGE", keyBuffer.String(), 0, 9))
-
-			for _, value := range values {
-				var build Build
-
-				bytes, err := redis.Bytes(value, err)
+			builds, err := store.ListBuilds(10)
 
-				if err != nil {
-					log.Printf(err.Error())
-
-					continue
-				}
-
-				err = json.Unmarshal(bytes, &build)
+			if err != nil {
+				log.Printf("Could not list builds: %v", err)
+				w.WriteHeader(http.StatusInternalServerError)
 
-				if err != nil {
-					log.Printf(err.Error())
-				} else {
-					builds = append(builds, &build)
-				}
+				return
 			}
 
 			body, _ = json.Marshal(&builds)
 		case 3:
-			keyBuffer.WriteString(":")
-			keyBuffer.WriteString(urlPath[2])
+			build, err := store.GetBuild(urlPath[2])
 
-			reply, err := conn.Do("GET", keyBuffer.String())
+			if err == errBuildNotFound {
+				w.WriteHeader(http.StatusNotFound)
+
+				return
+			}
 
 			if err != nil {
-				log.Printf("Could not get key: %s", keyBuffer.String())
+				log.Printf("Could not get build %s: %v", urlPath[2], err)
 				w.WriteHeader(http.StatusInternalServerError)
 
 				return
-			} else {
-				var (
-					build     Build
-					logBuffer bytes.Buffer
-				)
+			}
 
-				bytes, err := redis.Bytes(reply, err)
+			lines, err := store.ReadLog(build.Id, "", 0)
 
-				if err != nil {
-					log.Printf(err.Error())
-					w.WriteHeader(http.StatusInternalServerError)
+			if err != nil {
+				log.Printf("Could not read the log of build %s: %v", build.Id, err)
+				w.WriteHeader(http.StatusInternalServerError)
 
-					return
-				}
+				return
+			}
 
-				err = json.Unmarshal(bytes, &build)
+			positions := queue.Positions(build.Id)
 
-				if err != nil {
-					log.Printf(err.Error())
-					w.WriteHeader(http.StatusInternalServerError)
+			for _, task := range build.Tasks {
+				task.QueuePosition = positions[task.Id]
+			}
 
-					return
-				}
+			build.Log = strings.Join(lines, "\n")
+			body, err = json.Marshal(build)
 
-				values, err := redis.Values(conn.Do("LRANGE", build.RedisLogKey(), 0, -1))
+			if err != nil {
+				log.Print(err)
+				w.WriteHeader(http.StatusInternalServerError)
 
-				if err != nil {
-					log.Printf(err.Error())
-					w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+		case 5:
+			if urlPath[3] != "log" || urlPath[4] != "stream" {
+				w.WriteHeader(http.StatusNotFound)
 
-					return
-				}
+				return
+			}
 
-				for index, value := range values {
-					bytes, _ := redis.Bytes(value, err)
+			r.streamLog(w, req, urlPath[2], "")
 
-					if index != 0 {
-						logBuffer.WriteString("\n")
-					}
+			return
+		case 6:
+			if urlPath[3] != "tasks" || urlPath[5] != "log" {
+				w.WriteHeader(http.StatusNotFound)
 
-					logBuffer.WriteString(string(bytes[:]))
-				}
+				return
+			}
 
-				build.Log = logBuffer.String()
+			lines, err := store.ReadLog(urlPath[2], urlPath[4], 0)
 
-				body, err = json.Marshal(&build)
+			if err != nil {
+				log.Printf("Could not read the log of task %s: %v", urlPath[4], err)
+				w.WriteHeader(http.StatusInternalServerError)
 
-				if err != nil {
-					log.Printf(err.Error())
-					w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+
+			w.Header().Set("Content-Type", "text/plain")
+			w.WriteHeader(http.StatusOK)
+			w.Write([]byte(strings.Join(lines, "\n")))
 
-					return
-				}
+			return
+		case 7:
+			if urlPath[3] != "tasks" || urlPath[5] != "log" || urlPath[6] != "stream" {
+				w.WriteHeader(http.StatusNotFound)
+
+				return
 			}
+
+			r.streamLog(w, req, urlPath[2], urlPath[4])
+
+			return
 		default:
 			break
 		}
 
 		w.WriteHeader(http.StatusOK)
 	case "POST":
+		urlPath := strings.Split(req.URL.Path, "/")
+
+		if len(urlPath) == 6 && urlPath[3] == "tasks" && urlPath[5] == "log" {
+			r.ingestTaskOutput(w, req, urlPath[2], urlPath[4])
+
+			return
+		}
+
 		body, err = ioutil.ReadAll(req.Body)
 
 		if err != nil {
@@ -152,43 +161,107 @@ func (r *Routes) Builds(w http.ResponseWriter, req *http.Request) {
 			return
 		}
 
-		b := NewBuild()
-		err = json.Unmarshal(body, b)
+		var buildReq buildRequest
+
+		err = json.Unmarshal(body, &buildReq)
 
 		if err != nil {
-			log.Printf("Could not unmarshal the request body: ", err)
+			log.Printf("Could not unmarshal the request body: %v", err)
 			w.WriteHeader(http.StatusInternalServerError)
 
 			return
 		}
 
-		err = b.Save()
+		b := NewBuild()
+		b.App = buildReq.App
+		b.Branch = buildReq.Branch
+		b.Manifest = buildReq.Manifest
+		b.Priority = buildReq.Priority
+
+		if buildReq.BaseImage != "" {
+			b.BaseImage = buildReq.BaseImage
+		}
+
+		if b.Priority == 0 && b.Branch == "master" {
+			b.Priority = masterBranchPriority
+		}
+
+		err = store.CreateBuild(b)
 
 		if err != nil {
-			log.Printf("Could not save the build: ", err)
+			log.Printf("Could not save the build: %v", err)
 			w.WriteHeader(http.StatusInternalServerError)
 
 			return
 		}
 
-		body, err = json.Marshal(*b)
+		body, err = json.Marshal(b)
 
 		if err != nil {
-			log.Printf("Could not marshal the build: ", err)
+			log.Printf("Could not marshal the build: %v", err)
 			w.WriteHeader(http.StatusInternalServerError)
 
 			return
 		}
 
-		_, err = conn.Do("LPUSH", "pugio:builds", body)
+		runningBuilds.Add(b)
+
+		go b.Build()
+
+		w.WriteHeader(http.StatusCreated)
+	case "DELETE":
+		urlPath := strings.Split(req.URL.Path, "/")
+
+		if len(urlPath) != 3 {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+
+			return
+		}
+
+		b := runningBuilds.Get(urlPath[2])
+
+		if b == nil {
+			b, err = store.GetBuild(urlPath[2])
+
+			if err == errBuildNotFound {
+				w.WriteHeader(http.StatusNotFound)
+
+				return
+			}
+
+			if err != nil {
+				log.Printf("Could not load build %s: %v", urlPath[2], err)
+				w.WriteHeader(http.StatusInternalServerError)
+
+				return
+			}
+		}
+
+		err = b.Cancel()
+
+		if err == errBuildFinished {
+			w.WriteHeader(http.StatusConflict)
+
+			return
+		}
 
 		if err != nil {
-			log.Print(err)
+			log.Printf("Could not cancel build %s: %v", b.Id, err)
+			w.WriteHeader(http.StatusInternalServerError)
+
+			return
 		}
 
-		go b.Build()
+		body, err = json.Marshal(b)
 
-		w.WriteHeader(http.StatusCreated)
+		if err != nil {
+			log.Printf("Could not marshal the build: %v", err)
+			w.WriteHeader(http.StatusInternalServerError)
+
+			return
+		}
+
+		w.WriteHeader(http.StatusOK)
 	default:
 		w.WriteHeader(http.StatusMethodNotAllowed)
 	}
@@ -196,3 +269,77 @@ func (r *Routes) Builds(w http.ResponseWriter, req *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 	w.Write(body)
 }
+
+// ingestTaskOutput appends output POSTed by an executor to a task's log.
+func (r *Routes) ingestTaskOutput(w http.ResponseWriter, req *http.Request, buildId string, taskId string) {
+	build, err := store.GetBuild(buildId)
+
+	if err == errBuildNotFound {
+		w.WriteHeader(http.StatusNotFound)
+
+		return
+	}
+
+	if err != nil {
+		log.Printf("Could not load build %s: %v", buildId, err)
+		w.WriteHeader(http.StatusInternalServerError)
+
+		return
+	}
+
+	if build.Task(taskId) == nil {
+		w.WriteHeader(http.StatusNotFound)
+
+		return
+	}
+
+	body, err := ioutil.ReadAll(req.Body)
+
+	if err != nil {
+		log.Printf("Could not read the request body: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+
+		return
+	}
+
+	output := &TaskOutput{BuildId: buildId, TaskId: taskId, Output: string(body)}
+	err = output.Save()
+
+	if err != nil {
+		log.Printf("Could not save output of task %s: %v", taskId, err)
+		w.WriteHeader(http.StatusInternalServerError)
+
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Queue lists the queued tasks in the order they are due to run.
+func (r *Routes) Queue(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	log.Printf("%s %s", req.Method, req.URL.Path)
+
+	if req.Method != "GET" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+
+		return
+	}
+
+	queued := queue.List()
+	body, err := json.Marshal(map[string]interface{}{
+		"depth": len(queued),
+		"tasks": queued,
+	})
+
+	if err != nil {
+		log.Printf("Could not marshal the queue: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(body)
+}
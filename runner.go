@@ -0,0 +1,94 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+
+	util "github.com/mesos/mesos-go/mesosutil"
+	sched "github.com/mesos/mesos-go/scheduler"
+)
+
+// Runner takes the tasks queued by builds and runs them, reporting their
+// progress as Mesos task statuses on the channel of the owning build.
+type Runner interface {
+	// Run blocks for as long as the runner is able to run tasks.
+	Run() error
+	// KillTask stops the attempt with the given id.
+	KillTask(id string) error
+	// Adopt takes over the current attempt of a task launched before
+	// Gladius restarted.
+	Adopt(task *Task)
+	// NeedsPushedImage reports whether tasks run away from the Docker
+	// daemon that builds the image, so it must be pushed to a registry.
+	NeedsPushedImage() bool
+}
+
+// NewRunner creates the runner named by RUNNER: mesos, which is the default,
+// or docker.
+func NewRunner() (Runner, error) {
+	switch os.Getenv("RUNNER") {
+	case "", "mesos":
+		scheduler := NewScheduler()
+		driver, err := NewSchedulerDriver(scheduler)
+
+		if err != nil {
+			return nil, err
+		}
+
+		schedulerDriver = driver
+
+		return &MesosRunner{driver: driver, scheduler: scheduler}, nil
+	case "docker":
+		concurrency := 2
+
+		if os.Getenv("RUNNER_CONCURRENCY") != "" {
+			var err error
+
+			concurrency, err = strconv.Atoi(os.Getenv("RUNNER_CONCURRENCY"))
+
+			if err != nil {
+				return nil, fmt.Errorf("Failed to parse RUNNER_CONCURRENCY: %v", err)
+			}
+		}
+
+		return NewDockerRunner(concurrency), nil
+	default:
+		return nil, fmt.Errorf("Unknown RUNNER %s", os.Getenv("RUNNER"))
+	}
+}
+
+// MesosRunner runs tasks across a Mesos cluster through the scheduler.
+type MesosRunner struct {
+	driver    *sched.MesosSchedulerDriver
+	scheduler *Scheduler
+}
+
+func (r *MesosRunner) Run() error {
+	go r.scheduler.run()
+
+	stat, err := r.driver.Run()
+
+	if err != nil {
+		return fmt.Errorf("Framework stopped with status %s and error: %v", stat.String(), err)
+	}
+
+	return nil
+}
+
+func (r *MesosRunner) KillTask(id string) error {
+	_, err := r.driver.KillTask(util.NewTaskID(id))
+
+	return err
+}
+
+// Adopt routes status updates for the attempt to its build again. The attempt
+// carries on running on the cluster, and reconciliation catches up on any
+// updates missed during the restart.
+func (r *MesosRunner) Adopt(task *Task) {
+	r.scheduler.route(task.Attempt().Id, task.Build)
+}
+
+func (r *MesosRunner) NeedsPushedImage() bool {
+	return true
+}
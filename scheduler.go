@@ -2,7 +2,10 @@ package main
 
 import (
 	"encoding/json"
+	"fmt"
 	"log"
+	"strconv"
+	"sync"
 	"time"
 
 	proto "github.com/gogo/protobuf/proto"
@@ -12,122 +15,371 @@ import (
 )
 
 const (
-	offerTimeout = 1 * time.Minute
+	offerTimeout          = 1 * time.Minute
+	frameworkRemovedError = "Framework has been removed"
+	gladiusTaskExecutor   = "gladius"
+	dockerTaskExecutor    = "docker"
+	buildExecutorScope    = "build"
+	taskExecutorScope     = "task"
 )
 
 var (
 	filters = &mesos.Filters{RefuseSeconds: proto.Float64(5)}
+	// Offers declined while nothing is queued are refused for longer, until
+	// tasks are queued and offers revived.
+	idleFilters = &mesos.Filters{RefuseSeconds: proto.Float64(300)}
 )
 
 type Scheduler struct {
-	executor          *mesos.ExecutorInfo
-	tasksLaunched     int
-	tasksFinished     int
-	taskStatusesChans map[string]chan *mesos.TaskStatus
+	tasksLaunched  int
+	tasksFinished  int
+	mutex          sync.Mutex
+	taskBuilds     map[string]*Build
+	reconciliation int
+	reconciling    map[string]*mesos.TaskStatus
+	offers         *OfferPool
+	offered        chan bool
+	suppressed     bool
 }
 
 func NewScheduler() *Scheduler {
 	return &Scheduler{
-		executor: &mesos.ExecutorInfo{
-			ExecutorId: util.NewExecutorID(executorId),
-			Command:    util.NewCommandInfo(executorCommand),
-		},
-		tasksLaunched:     0,
-		tasksFinished:     0,
-		taskStatusesChans: make(map[string]chan *mesos.TaskStatus),
+		tasksLaunched: 0,
+		tasksFinished: 0,
+		taskBuilds:    make(map[string]*Build),
+		reconciling:   make(map[string]*mesos.TaskStatus),
+		offers:        NewOfferPool(),
+		offered:       make(chan bool, 1),
+	}
+}
+
+// run matches queued tasks with held offers whenever either arrives, and
+// declines the offers held for longer than offerTimeout.
+func (s *Scheduler) run() {
+	expiry := time.NewTicker(offerTimeout / 4)
+
+	defer expiry.Stop()
+
+	for {
+		select {
+		case <-s.offered:
+		case <-queue.Pushed():
+			s.revive()
+		case <-expiry.C:
+			for _, offer := range s.offers.Expire(offerTimeout) {
+				log.Printf("No tasks fit offer %s in time; Declining it", offer.Id.GetValue())
+				schedulerDriver.DeclineOffer(offer.Id, filters)
+			}
+		}
+
+		s.launchTasks()
 	}
 }
 
 func (s *Scheduler) Registered(driver sched.SchedulerDriver, frameworkId *mesos.FrameworkID, masterInfo *mesos.MasterInfo) {
 	log.Printf("Framework Registered with Master %v", masterInfo)
+
+	err := store.SaveFrameworkId(frameworkId.GetValue())
+
+	if err != nil {
+		log.Printf("Could not save framework id %s: %v", frameworkId.GetValue(), err)
+	}
+
+	go s.reconcile(driver)
 }
 
 func (s *Scheduler) Reregistered(driver sched.SchedulerDriver, masterInfo *mesos.MasterInfo) {
 	log.Printf("Framework Re-Registered with Master %v", masterInfo)
+
+	go s.reconcile(driver)
 }
 
 func (s *Scheduler) Disconnected(sched.SchedulerDriver) {
-	log.Printf("Disconnected")
+	log.Printf("Disconnected; Tasks will be reconciled once registered again")
+
+	// Offers do not survive the master losing track of the framework.
+	s.offers.Clear()
 }
 
 func (s *Scheduler) ResourceOffers(driver sched.SchedulerDriver, offers []*mesos.Offer) {
 	for _, offer := range offers {
 		log.Printf("Received offer %s", offer.Id.GetValue())
-		go s.handleOffer(offer)
+		s.offers.Add(offer)
 	}
-}
 
-func (s *Scheduler) handleOffer(offer *mesos.Offer) {
 	select {
-	case task := <-tasks:
-		log.Printf("Launching task %s for offer %s", task.Id, offer.Id.GetValue())
-		s.launchTaskWithOffer(task, offer)
+	case s.offered <- true:
 	default:
-		log.Printf("No tasks available; Declining offer %s", offer.Id.GetValue())
-		schedulerDriver.DeclineOffer(offer.Id, filters)
 	}
 }
 
-func (s *Scheduler) launchTaskWithOffer(task *Task, offer *mesos.Offer) {
-	mems := 0.0
-	cpus := 0.0
-	taskJsonBytes, err := json.Marshal(task)
-	cpuResources := util.FilterResources(offer.Resources, func(res *mesos.Resource) bool {
-		return res.GetName() == "cpus"
-	})
-	memResources := util.FilterResources(offer.Resources, func(res *mesos.Resource) bool {
-		return res.GetName() == "mem"
-	})
+// launchTasks launches queued tasks with each held offer they fit. An offer
+// nothing fits is held for tasks queued later, or declined for a while if
+// nothing is queued. Tasks go back to the queue if their offer was rescinded
+// or the launch failed.
+func (s *Scheduler) launchTasks() {
+	for _, held := range s.offers.TakeAll() {
+		offer := held.offer
+		tasks, taskInfos := s.matchOffer(offer)
+
+		if len(taskInfos) == 0 && queue.Len() == 0 {
+			s.offers.Done(offer.Id.GetValue())
+			s.suppress(offer)
+
+			continue
+		}
+
+		if len(taskInfos) == 0 {
+			s.offers.Return(held)
+
+			continue
+		}
+
+		if s.offers.Done(offer.Id.GetValue()) {
+			log.Printf("Offer %s was rescinded; Requeueing %d tasks", offer.Id.GetValue(), len(tasks))
+			s.requeue(tasks)
 
-	for _, res := range cpuResources {
-		cpus += res.GetScalar().GetValue()
+			continue
+		}
+
+		log.Printf("Launching %d tasks for offer %s", len(taskInfos), offer.Id.GetValue())
+
+		_, err := schedulerDriver.LaunchTasks([]*mesos.OfferID{offer.Id}, taskInfos, filters)
+
+		if err != nil {
+			log.Printf("Could not launch tasks for offer %s: %v; Requeueing %d tasks", offer.Id.GetValue(), err, len(tasks))
+			s.requeue(tasks)
+		}
 	}
+}
+
+// suppress declines an offer with idleFilters while nothing is queued, which
+// the driver offers no better way to stop offers with.
+func (s *Scheduler) suppress(offer *mesos.Offer) {
+	s.mutex.Lock()
+	s.suppressed = true
+	s.mutex.Unlock()
+
+	log.Printf("No tasks queued; Declining offer %s", offer.Id.GetValue())
+	schedulerDriver.DeclineOffer(offer.Id, idleFilters)
+}
 
-	for _, res := range memResources {
-		mems += res.GetScalar().GetValue()
+// revive asks for offers again once tasks are queued after offers were
+// suppressed.
+func (s *Scheduler) revive() {
+	s.mutex.Lock()
+	suppressed := s.suppressed
+	s.suppressed = false
+	s.mutex.Unlock()
+
+	if !suppressed {
+		return
 	}
 
+	log.Printf("Tasks queued; Reviving offers")
+
+	_, err := schedulerDriver.ReviveOffers()
+
 	if err != nil {
-		log.Printf("Declining offer %s for task %s due to marshal error: %v", offer.Id.GetValue(), task.Id, err)
-		schedulerDriver.DeclineOffer(offer.Id, filters)
+		log.Printf("Could not revive offers: %v", err)
 
-		return
+		s.mutex.Lock()
+		s.suppressed = true
+		s.mutex.Unlock()
 	}
+}
 
-	if cpus < cpusPerTask || mems < memoryPerTask {
-		log.Printf("Declining offer %s for task %s due to insufficient offer resources", offer.Id.GetValue(), task.Id)
-		schedulerDriver.DeclineOffer(offer.Id, filters)
+// matchOffer fills the offer with as many queued tasks as its resources
+// allow.
+func (s *Scheduler) matchOffer(offer *mesos.Offer) ([]*Task, []*mesos.TaskInfo) {
+	resources := newOfferResources(offer)
+	tasks := []*Task{}
+	taskInfos := []*mesos.TaskInfo{}
 
-		return
+	for {
+		// Tasks too big for what is left of the offer, or whose
+		// constraints rule it out, stay queued for another offer.
+		task := queue.Pop(func(task *Task) bool {
+			return resources.fits(task) && task.AcceptsOffer(offer)
+		})
+
+		if task == nil {
+			break
+		}
+
+		if task.Build.cancelled() {
+			log.Printf("Build %s was cancelled; Skipping task %s for offer %s", task.BuildId, task.Id, offer.Id.GetValue())
+
+			continue
+		}
+
+		taskResources, ports := resources.take(task)
+		taskInfo, err := s.launchTaskWithOffer(task, offer, taskResources, ports)
+
+		if err != nil {
+			log.Printf("Skipping task %s for offer %s due to marshal error: %v", task.Id, offer.Id.GetValue(), err)
+
+			continue
+		}
+
+		tasks = append(tasks, task)
+		taskInfos = append(taskInfos, taskInfo)
+	}
+
+	return tasks, taskInfos
+}
+
+// requeue puts tasks that were never launched back where they were in the
+// queue, undoing launchTaskWithOffer.
+func (s *Scheduler) requeue(tasks []*Task) {
+	for _, task := range tasks {
+		task.Build.mutex.Lock()
+		attempt := task.Attempt()
+
+		s.mutex.Lock()
+		delete(s.taskBuilds, attempt.Id)
+		s.mutex.Unlock()
+
+		attempt.LaunchedAt = nil
+		attempt.SlaveId = ""
+		attempt.Hostname = ""
+		attempt.ExecutorId = ""
+		attempt.Ports = nil
+
+		task.log("Attempt %s was not launched; Requeueing it", attempt.Id)
+		task.Build.mutex.Unlock()
+		task.Build.requeue(task)
+	}
+}
+
+// launchTaskWithOffer describes the current attempt of a task for launching
+// with the given resources of the offer, and marks it as launched.
+func (s *Scheduler) launchTaskWithOffer(task *Task, offer *mesos.Offer, resources []*mesos.Resource, ports []uint64) (*mesos.TaskInfo, error) {
+	task.Build.mutex.Lock()
+	defer task.Build.mutex.Unlock()
+
+	attempt := task.Attempt()
+	attempt.Ports = ports
+	attempt.ExecutorId = executorIdFor(task)
+	taskJsonBytes, err := json.Marshal(task)
+
+	if err != nil {
+		return nil, err
 	}
 
 	taskId := &mesos.TaskID{
-		Value: proto.String(task.Id),
+		Value: proto.String(attempt.Id),
 	}
 
 	taskInfo := &mesos.TaskInfo{
-		Name:     proto.String(task.Cmd),
-		TaskId:   taskId,
-		SlaveId:  offer.SlaveId,
-		Data:     taskJsonBytes,
-		Executor: s.executor,
-		Resources: []*mesos.Resource{
-			util.NewScalarResource("cpus", cpusPerTask),
-			util.NewScalarResource("mem", memoryPerTask),
-		},
+		Name:      proto.String(task.Cmd),
+		TaskId:    taskId,
+		SlaveId:   offer.SlaveId,
+		Resources: resources,
+	}
+
+	// The Docker containerizer runs the command straight from the build
+	// image, so no executor is involved.
+	if taskExecutor == dockerTaskExecutor {
+		taskInfo.Command = dockerTaskCommand(task)
+		taskInfo.Container = &mesos.ContainerInfo{
+			Type: mesos.ContainerInfo_DOCKER.Enum(),
+			Docker: &mesos.ContainerInfo_DockerInfo{
+				Image: proto.String(task.Build.TaskImage()),
+			},
+		}
+	} else {
+		taskInfo.Executor = &mesos.ExecutorInfo{
+			ExecutorId: util.NewExecutorID(attempt.ExecutorId),
+			Command:    util.NewCommandInfo(executorCommand),
+		}
+		taskInfo.Data = taskJsonBytes
+	}
+
+	now := time.Now()
+	attempt.LaunchedAt = &now
+	attempt.SlaveId = offer.SlaveId.GetValue()
+	attempt.Hostname = offer.GetHostname()
+
+	task.log("Launching attempt %s on %s", attempt.Id, offer.GetHostname())
+	s.route(attempt.Id, task.Build)
+
+	return taskInfo, nil
+}
+
+// executorIdFor names the executor running the task's current attempt. Each
+// build, or each task when EXECUTOR_SCOPE is task, gets an executor of its own
+// so builds never share one. The Docker containerizer runs every task in a
+// command executor named after the task.
+func executorIdFor(task *Task) string {
+	if taskExecutor == dockerTaskExecutor {
+		return task.Attempt().Id
+	}
+
+	if executorScope == taskExecutorScope {
+		return fmt.Sprintf("%s.%s", executorId, task.Attempt().Id)
+	}
+
+	return fmt.Sprintf("%s.%s", executorId, task.BuildId)
+}
+
+// dockerTaskCommand runs the task's command in the checkout, with the ports
+// allocated to the attempt as PORT0, PORT1 and so on.
+func dockerTaskCommand(task *Task) *mesos.CommandInfo {
+	variables := []*mesos.Environment_Variable{}
+
+	for index, port := range task.Attempt().Ports {
+		variables = append(variables, &mesos.Environment_Variable{
+			Name:  proto.String(fmt.Sprintf("PORT%d", index)),
+			Value: proto.String(strconv.FormatUint(port, 10)),
+		})
 	}
 
-	s.taskStatusesChans[task.Id] = task.Build.TaskStatusesChan
+	return &mesos.CommandInfo{
+		Value:       proto.String(fmt.Sprintf("cd /%s && %s", task.Build.App, task.Cmd)),
+		Shell:       proto.Bool(true),
+		Environment: &mesos.Environment{Variables: variables},
+	}
+}
 
-	schedulerDriver.LaunchTasks([]*mesos.OfferID{offer.Id}, []*mesos.TaskInfo{taskInfo}, filters)
+// route sends status updates for the attempt to its build.
+func (s *Scheduler) route(attemptId string, build *Build) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.taskBuilds[attemptId] = build
 }
 
 func (s *Scheduler) StatusUpdate(driver sched.SchedulerDriver, status *mesos.TaskStatus) {
-	statusChan := s.taskStatusesChans[status.TaskId.GetValue()]
+	s.mutex.Lock()
+	build := s.taskBuilds[status.TaskId.GetValue()]
+
+	// No more updates are expected once a task is terminal.
+	if IsTerminalTaskState(status.GetState()) {
+		delete(s.taskBuilds, status.TaskId.GetValue())
+	}
+
+	s.mutex.Unlock()
+	s.reconciled(status.TaskId.GetValue())
 
 	log.Printf("Status update: task %v is in state %s", status.TaskId.GetValue(), status.State.Enum().String())
 
-	go func() { statusChan <- status }()
+	// No build waits for the tasks of a build that finished while Gladius
+	// was down.
+	if build == nil {
+		log.Printf("No build is waiting for task %v; Ignoring its status", status.TaskId.GetValue())
+
+		return
+	}
+
+	// A stopped build no longer reads its updates, e.g. those of the tasks
+	// killed as it was cancelled.
+	go func() {
+		select {
+		case build.TaskStatusesChan <- status:
+		case <-build.ctx.Done():
+		}
+	}()
 
 	if status.GetState() == mesos.TaskState_TASK_LOST ||
 		status.GetState() == mesos.TaskState_TASK_KILLED ||
@@ -136,22 +388,110 @@ func (s *Scheduler) StatusUpdate(driver sched.SchedulerDriver, status *mesos.Tas
 	}
 }
 
-func (s *Scheduler) OfferRescinded(sched.SchedulerDriver, *mesos.OfferID) {
-	log.Printf("Offer rescinded")
+func (s *Scheduler) OfferRescinded(driver sched.SchedulerDriver, offerId *mesos.OfferID) {
+	log.Printf("Offer %s rescinded", offerId.GetValue())
+
+	s.offers.Rescind(offerId.GetValue())
 }
 
-func (s *Scheduler) FrameworkMessage(sched.SchedulerDriver, *mesos.ExecutorID, *mesos.SlaveID, string) {
-	log.Printf("Framework received message")
+func (s *Scheduler) FrameworkMessage(driver sched.SchedulerDriver, executorId *mesos.ExecutorID, slaveId *mesos.SlaveID, message string) {
+	var output TaskOutput
+
+	err := json.Unmarshal([]byte(message), &output)
+
+	if err != nil {
+		log.Printf("Framework received unknown message from executor %s: %v", executorId.GetValue(), err)
+
+		return
+	}
+
+	err = output.Save()
+
+	if err != nil {
+		log.Printf("Could not save output of task %s: %v", output.TaskId, err)
+	}
 }
 
-func (s *Scheduler) SlaveLost(sched.SchedulerDriver, *mesos.SlaveID) {
-	log.Printf("Slave lost")
+func (s *Scheduler) SlaveLost(driver sched.SchedulerDriver, slaveId *mesos.SlaveID) {
+	log.Printf("Slave %s lost", slaveId.GetValue())
+
+	message := fmt.Sprintf("Slave %s was lost", slaveId.GetValue())
+
+	s.loseTasks(driver, mesos.TaskStatus_REASON_SLAVE_REMOVED, message, func(attempt *Attempt) bool {
+		return attempt.SlaveId == slaveId.GetValue()
+	})
 }
 
-func (s *Scheduler) ExecutorLost(sched.SchedulerDriver, *mesos.ExecutorID, *mesos.SlaveID, int) {
-	log.Printf("Executor lost")
+func (s *Scheduler) ExecutorLost(driver sched.SchedulerDriver, executorId *mesos.ExecutorID, slaveId *mesos.SlaveID, status int) {
+	log.Printf("Executor %s lost on slave %s with status %d", executorId.GetValue(), slaveId.GetValue(), status)
+
+	message := fmt.Sprintf("Executor %s was lost on slave %s", executorId.GetValue(), slaveId.GetValue())
+
+	s.loseTasks(driver, mesos.TaskStatus_REASON_EXECUTOR_TERMINATED, message, func(attempt *Attempt) bool {
+		return attempt.ExecutorId == executorId.GetValue() && attempt.SlaveId == slaveId.GetValue()
+	})
+}
+
+// loseTasks reports the running tasks that match as lost through the usual
+// status update path, since Mesos may never send their status once their
+// slave or executor is gone. Their builds then retry them as they see fit.
+func (s *Scheduler) loseTasks(driver sched.SchedulerDriver, reason mesos.TaskStatus_Reason, message string, match func(*Attempt) bool) {
+	for _, task := range runningTasks(match) {
+		task.Build.mutex.Lock()
+		attempt := task.Attempt()
+		slaveId := attempt.SlaveId
+		task.Build.mutex.Unlock()
+
+		task.Build.log("Task %s attempt %s is lost: %s", task.Id, attempt.Id, message)
+
+		s.StatusUpdate(driver, &mesos.TaskStatus{
+			TaskId:    util.NewTaskID(attempt.Id),
+			State:     mesos.TaskState_TASK_LOST.Enum(),
+			Message:   proto.String(message),
+			Source:    mesos.TaskStatus_SOURCE_MASTER.Enum(),
+			Reason:    reason.Enum(),
+			SlaveId:   util.NewSlaveID(slaveId),
+			Timestamp: proto.Float64(float64(time.Now().UnixNano()) / float64(time.Second)),
+		})
+	}
 }
 
 func (s *Scheduler) Error(driver sched.SchedulerDriver, err string) {
 	log.Printf("Scheduler received error: %v", err)
+
+	// The master forgets a framework that fails over too late, so the next
+	// start should register afresh rather than with the stale id.
+	if err == frameworkRemovedError {
+		storeErr := store.SaveFrameworkId("")
+
+		if storeErr != nil {
+			log.Printf("Could not forget framework id: %v", storeErr)
+		}
+	}
+}
+
+// runningTasks returns the tasks of the builds running in this process whose
+// current attempt was launched, has not finished and matches.
+func runningTasks(match func(*Attempt) bool) []*Task {
+	tasks := []*Task{}
+
+	for _, build := range runningBuilds.All() {
+		build.mutex.Lock()
+
+		for _, task := range build.Tasks {
+			attempt := task.Attempt()
+
+			if attempt == nil || attempt.LaunchedAt == nil || task.IsTerminal() {
+				continue
+			}
+
+			if match(attempt) {
+				tasks = append(tasks, task)
+			}
+		}
+
+		build.mutex.Unlock()
+	}
+
+	return tasks
 }
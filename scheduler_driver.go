@@ -1,20 +1,35 @@
 package main
 
 import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"log"
 	"net"
 	"os"
 	"strconv"
 
 	proto "github.com/gogo/protobuf/proto"
+	auth "github.com/mesos/mesos-go/auth"
+	sasl "github.com/mesos/mesos-go/auth/sasl"
+	_ "github.com/mesos/mesos-go/auth/sasl/mech/crammd5"
 	mesos "github.com/mesos/mesos-go/mesosproto"
+	util "github.com/mesos/mesos-go/mesosutil"
 	sched "github.com/mesos/mesos-go/scheduler"
+	context "golang.org/x/net/context"
 )
 
-func NewSchedulerDriver() (*sched.MesosSchedulerDriver, error) {
+const (
+	// A week, in seconds.
+	defaultFailoverTimeout = 7 * 24 * 60 * 60
+)
+
+func NewSchedulerDriver(scheduler *Scheduler) (*sched.MesosSchedulerDriver, error) {
 	var (
-		masterPort    int
-		schedulerPort int
-		err           error
+		masterPort      int
+		schedulerPort   int
+		failoverTimeout float64
+		err             error
 	)
 
 	masterPort = 5050
@@ -37,6 +52,24 @@ func NewSchedulerDriver() (*sched.MesosSchedulerDriver, error) {
 		}
 	}
 
+	// Mesos keeps the framework's tasks running for this many seconds after
+	// Gladius disconnects, waiting for it to fail over.
+	failoverTimeout = defaultFailoverTimeout
+
+	if os.Getenv("FRAMEWORK_FAILOVER_TIMEOUT") != "" {
+		failoverTimeout, err = strconv.ParseFloat(os.Getenv("FRAMEWORK_FAILOVER_TIMEOUT"), 64)
+
+		if err != nil {
+			return nil, fmt.Errorf("Failed to parse FRAMEWORK_FAILOVER_TIMEOUT: %v", err)
+		}
+	}
+
+	frameworkId, err := store.FrameworkId()
+
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read the framework id: %v", err)
+	}
+
 	schedulerTCPAddr := net.TCPAddr{
 		IP:   net.ParseIP(os.Getenv("SCHEDULER_IP")),
 		Port: schedulerPort,
@@ -45,17 +78,72 @@ func NewSchedulerDriver() (*sched.MesosSchedulerDriver, error) {
 		IP:   net.ParseIP(os.Getenv("MASTER_PORT_5050_TCP_ADDR")),
 		Port: masterPort,
 	}
+	master := mesosTCPAddr.String()
+
+	// MASTER names the masters to follow the leader of, either as a zk://
+	// URL or a comma-separated list, over the single linked master.
+	if os.Getenv("MASTER") != "" {
+		master = masterSpec(os.Getenv("MASTER"))
+	}
+
+	// Slaves checkpoint the framework's tasks unless disabled, so they
+	// survive a slave restart.
+	checkpoint := true
+
+	if os.Getenv("FRAMEWORK_CHECKPOINT") != "" {
+		checkpoint, err = strconv.ParseBool(os.Getenv("FRAMEWORK_CHECKPOINT"))
+
+		if err != nil {
+			return nil, fmt.Errorf("Failed to parse FRAMEWORK_CHECKPOINT: %v", err)
+		}
+	}
+
+	// An empty user is filled in by the driver with the current user.
 	frameworkInfo := &mesos.FrameworkInfo{
-		User: proto.String(""),
-		Name: proto.String(frameworkName),
+		User:            proto.String(os.Getenv("FRAMEWORK_USER")),
+		Name:            proto.String(frameworkName),
+		FailoverTimeout: proto.Float64(failoverTimeout),
+		Checkpoint:      proto.Bool(checkpoint),
+		Role:            proto.String(frameworkRole),
+	}
+
+	if os.Getenv("FRAMEWORK_WEBUI_URL") != "" {
+		frameworkInfo.WebuiUrl = proto.String(os.Getenv("FRAMEWORK_WEBUI_URL"))
 	}
+
+	if frameworkId != "" {
+		log.Printf("Failing over to framework %s", frameworkId)
+
+		frameworkInfo.Id = util.NewFrameworkID(frameworkId)
+	}
+
 	driverConfig := sched.DriverConfig{
-		Scheduler:      NewScheduler(),
-		Framework:      frameworkInfo,
-		Master:         mesosTCPAddr.String(),
-		BindingAddress: schedulerTCPAddr.IP,
-		BindingPort:    uint16(schedulerTCPAddr.Port),
+		Scheduler:        scheduler,
+		Framework:        frameworkInfo,
+		Master:           master,
+		HostnameOverride: os.Getenv("FRAMEWORK_HOSTNAME"),
+		BindingAddress:   schedulerTCPAddr.IP,
+		BindingPort:      uint16(schedulerTCPAddr.Port),
+	}
+
+	// The framework authenticates with the master as its principal when
+	// one is set, using the secret read from FRAMEWORK_SECRET_FILE.
+	if os.Getenv("FRAMEWORK_PRINCIPAL") != "" {
+		credential, err := frameworkCredential(os.Getenv("FRAMEWORK_PRINCIPAL"), os.Getenv("FRAMEWORK_SECRET_FILE"))
+
+		if err != nil {
+			return nil, err
+		}
+
+		frameworkInfo.Principal = credential.Principal
+		driverConfig.Credential = credential
+		driverConfig.WithAuthContext = func(ctx context.Context) context.Context {
+			ctx = auth.WithLoginProvider(ctx, sasl.ProviderName)
+
+			return sasl.WithBindingAddress(ctx, schedulerTCPAddr.IP)
+		}
 	}
+
 	driver, err := sched.NewMesosSchedulerDriver(driverConfig)
 
 	if err != nil {
@@ -63,5 +151,24 @@ func NewSchedulerDriver() (*sched.MesosSchedulerDriver, error) {
 	}
 
 	return driver, nil
+}
+
+func frameworkCredential(principal string, secretFile string) (*mesos.Credential, error) {
+	credential := &mesos.Credential{
+		Principal: proto.String(principal),
+	}
+
+	if secretFile == "" {
+		return credential, nil
+	}
+
+	secret, err := ioutil.ReadFile(secretFile)
+
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read FRAMEWORK_SECRET_FILE: %v", err)
+	}
+
+	credential.Secret = bytes.TrimSpace(secret)
 
+	return credential, nil
 }
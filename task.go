@@ -1,22 +1,169 @@
 package main
 
 import (
+	"fmt"
 	mesos "github.com/mesos/mesos-go/mesosproto"
+	"log"
 	"math/rand"
 	"strconv"
+	"time"
 )
 
 type Task struct {
-	Id      string            `json:"id,omitempty"`
-	Cmd     string            `json:"cmd,omitempty"`
-	Build   *Build            `json:"-"`
-	BuildId string            `json:"buildId,omitempty"`
-	Status  *mesos.TaskStatus `json:"status,omitempty"`
+	Id            string            `json:"id,omitempty"`
+	Cmd           string            `json:"cmd,omitempty"`
+	Cpus          float64           `json:"cpus,omitempty"`
+	Mem           float64           `json:"mem,omitempty"`
+	Disk          float64           `json:"disk,omitempty"`
+	Ports         int               `json:"ports,omitempty"`
+	MaxAttempts   int               `json:"maxAttempts,omitempty"`
+	RetryFailures bool              `json:"retryFailures,omitempty"`
+	Constraints   []string          `json:"constraints,omitempty"`
+	Timeout       string            `json:"timeout,omitempty"`
+	TimedOut      bool              `json:"timedOut,omitempty"`
+	Build         *Build            `json:"-"`
+	BuildId       string            `json:"buildId,omitempty"`
+	Status        *mesos.TaskStatus `json:"status,omitempty"`
+	Attempts      []*Attempt        `json:"attempts,omitempty"`
+	QueuePosition int               `json:"queuePosition,omitempty"`
+	queueOrder    int
+}
+
+// Attempt is one launch of a task on the cluster. Its id is the Mesos task
+// id, so status updates for an earlier attempt never affect a later one.
+type Attempt struct {
+	Id         string            `json:"id"`
+	Status     *mesos.TaskStatus `json:"status,omitempty"`
+	LaunchedAt *time.Time        `json:"launchedAt,omitempty"`
+	StartedAt  *time.Time        `json:"startedAt,omitempty"`
+	SlaveId    string            `json:"slaveId,omitempty"`
+	ExecutorId string            `json:"executorId,omitempty"`
+	Hostname   string            `json:"hostname,omitempty"`
+	Ports      []uint64          `json:"ports,omitempty"`
 }
 
 func NewTask(cmd string) *Task {
 	return &Task{
-		Id:  strconv.Itoa(rand.Int()),
-		Cmd: cmd,
+		Id:          strconv.Itoa(rand.Int()),
+		Cmd:         cmd,
+		Cpus:        cpusPerTask,
+		Mem:         memoryPerTask,
+		Disk:        diskPerTask,
+		MaxAttempts: taskMaxAttempts,
+	}
+}
+
+func IsTerminalTaskState(state mesos.TaskState) bool {
+	switch state {
+	case mesos.TaskState_TASK_FINISHED,
+		mesos.TaskState_TASK_FAILED,
+		mesos.TaskState_TASK_KILLED,
+		mesos.TaskState_TASK_LOST,
+		mesos.TaskState_TASK_ERROR:
+		return true
+	}
+
+	return false
+}
+
+// IsInfrastructureFailure reports whether a terminal status was caused by the
+// cluster, e.g. a lost slave or executor, rather than by the command itself.
+func IsInfrastructureFailure(status *mesos.TaskStatus) bool {
+	switch status.GetState() {
+	case mesos.TaskState_TASK_LOST:
+		return true
+	case mesos.TaskState_TASK_FAILED:
+		if status.Reason == nil {
+			return false
+		}
+
+		switch status.GetReason() {
+		case mesos.TaskStatus_REASON_EXECUTOR_PREEMPTED,
+			mesos.TaskStatus_REASON_EXECUTOR_TERMINATED,
+			mesos.TaskStatus_REASON_EXECUTOR_UNREGISTERED,
+			mesos.TaskStatus_REASON_SLAVE_DISCONNECTED,
+			mesos.TaskStatus_REASON_SLAVE_REMOVED,
+			mesos.TaskStatus_REASON_SLAVE_RESTARTED,
+			mesos.TaskStatus_REASON_SLAVE_UNKNOWN:
+			return true
+		}
+	}
+
+	return false
+}
+
+func (t *Task) IsTerminal() bool {
+	return t.Status != nil && IsTerminalTaskState(t.Status.GetState())
+}
+
+func (t *Task) Passed() bool {
+	return t.Status != nil && t.Status.GetState() == mesos.TaskState_TASK_FINISHED
+}
+
+// log records a message about the task in the build log, keeping the task's
+// own log for the output of its command.
+func (t *Task) log(msg string, args ...interface{}) {
+	msg = fmt.Sprintf(msg, args...)
+	err := store.AppendLog(t.BuildId, "", fmt.Sprintf("[%s] Task %s: %s", time.Now().String(), t.Id, msg))
+
+	if err != nil {
+		log.Print(err)
 	}
+
+	log.Printf("[Task %s] %s", t.Id, msg)
+}
+
+// Attempt returns the task's current attempt, if it was ever queued.
+func (t *Task) Attempt() *Attempt {
+	if len(t.Attempts) == 0 {
+		return nil
+	}
+
+	return t.Attempts[len(t.Attempts)-1]
+}
+
+func (t *Task) AttemptById(id string) *Attempt {
+	for _, attempt := range t.Attempts {
+		if attempt.Id == id {
+			return attempt
+		}
+	}
+
+	return nil
+}
+
+// NewAttempt starts a fresh attempt, clearing the status of the previous one.
+func (t *Task) NewAttempt() *Attempt {
+	attempt := &Attempt{
+		Id: fmt.Sprintf("%s.%d", t.Id, len(t.Attempts)+1),
+	}
+
+	t.Attempts = append(t.Attempts, attempt)
+	t.Status = nil
+
+	return attempt
+}
+
+// ParseTimeout returns how long an attempt may run, or zero if it may run for
+// as long as the build.
+func (t *Task) ParseTimeout() (time.Duration, error) {
+	if t.Timeout == "" {
+		return 0, nil
+	}
+
+	return time.ParseDuration(t.Timeout)
+}
+
+// ShouldRetry reports whether the terminal status of the current attempt
+// warrants another one under the task's retry policy.
+func (t *Task) ShouldRetry() bool {
+	if !t.IsTerminal() || t.TimedOut || len(t.Attempts) >= t.MaxAttempts {
+		return false
+	}
+
+	if IsInfrastructureFailure(t.Status) {
+		return true
+	}
+
+	return t.RetryFailures && t.Status.GetState() == mesos.TaskState_TASK_FAILED
 }
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"strings"
+)
+
+// TaskOutput carries output of a task's command back from the executor
+// running it, either as the JSON data of a framework message or as the body
+// of a POST to /builds/{id}/tasks/{taskId}/log. Executors are expected to send
+// whole lines; each line is stored as an entry of the task's log.
+type TaskOutput struct {
+	BuildId string `json:"buildId"`
+	TaskId  string `json:"taskId"`
+	Output  string `json:"output"`
+}
+
+func (o *TaskOutput) Save() error {
+	output := strings.TrimSuffix(o.Output, "\n")
+
+	if output == "" {
+		return nil
+	}
+
+	for _, line := range strings.Split(output, "\n") {
+		err := store.AppendLog(o.BuildId, o.TaskId, line)
+
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,262 @@
+package main
+
+import (
+	"sync"
+)
+
+const (
+	// Builds of the master branch run ahead of feature branches unless
+	// they are given a priority.
+	masterBranchPriority = 10
+)
+
+// TaskQueue holds the tasks waiting to run. Tasks of the highest priority
+// builds go first. Within a priority, apps take turns, the app served least
+// recently going next, and each app's tasks run in the order they were queued.
+type TaskQueue struct {
+	mutex      sync.Mutex
+	cond       *sync.Cond
+	entries    []*queueEntry
+	served     map[string]int
+	dispatches int
+	pushes     int
+	pushed     chan bool
+}
+
+type queueEntry struct {
+	task     *Task
+	app      string
+	priority int
+}
+
+// QueuedTask describes a task's place in the queue.
+type QueuedTask struct {
+	BuildId  string `json:"buildId"`
+	TaskId   string `json:"taskId"`
+	App      string `json:"app"`
+	Priority int    `json:"priority"`
+	Position int    `json:"position"`
+}
+
+func NewTaskQueue() *TaskQueue {
+	q := &TaskQueue{
+		entries: []*queueEntry{},
+		served:  make(map[string]int),
+		pushed:  make(chan bool, 1),
+	}
+	q.cond = sync.NewCond(&q.mutex)
+
+	return q
+}
+
+func (q *TaskQueue) Push(task *Task) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	q.pushes++
+	task.queueOrder = q.pushes
+	q.entries = append(q.entries, &queueEntry{
+		task:     task,
+		app:      task.Build.App,
+		priority: task.Build.Priority,
+	})
+	q.signal()
+}
+
+// Requeue puts a popped task back where it was, ahead of the tasks pushed
+// after it.
+func (q *TaskQueue) Requeue(task *Task) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	entry := &queueEntry{
+		task:     task,
+		app:      task.Build.App,
+		priority: task.Build.Priority,
+	}
+	i := 0
+
+	for i < len(q.entries) && q.entries[i].task.queueOrder < task.queueOrder {
+		i++
+	}
+
+	q.entries = append(q.entries[:i], append([]*queueEntry{entry}, q.entries[i:]...)...)
+	q.signal()
+}
+
+func (q *TaskQueue) signal() {
+	q.cond.Signal()
+
+	select {
+	case q.pushed <- true:
+	default:
+	}
+}
+
+// Pushed receives a value after tasks are pushed, for a single consumer that
+// pops tasks as they become available.
+func (q *TaskQueue) Pushed() <-chan bool {
+	return q.pushed
+}
+
+// Pop removes and returns the next task for which fits is true, or nil if
+// there is none.
+func (q *TaskQueue) Pop(fits func(*Task) bool) *Task {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	entry := q.pop(fits)
+
+	if entry == nil {
+		return nil
+	}
+
+	return entry.task
+}
+
+// Wait removes and returns the next task, waiting for one to be queued.
+func (q *TaskQueue) Wait() *Task {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	for {
+		entry := q.pop(nil)
+
+		if entry != nil {
+			return entry.task
+		}
+
+		q.cond.Wait()
+	}
+}
+
+// Remove withdraws the queued tasks of a build.
+func (q *TaskQueue) Remove(buildId string) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	entries := []*queueEntry{}
+
+	for _, entry := range q.entries {
+		if entry.task.BuildId != buildId {
+			entries = append(entries, entry)
+		}
+	}
+
+	q.entries = entries
+}
+
+func (q *TaskQueue) Len() int {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	return len(q.entries)
+}
+
+// List returns the queued tasks in the order they would be dispatched, were
+// every offer big enough for any of them.
+func (q *TaskQueue) List() []*QueuedTask {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	listed := []*QueuedTask{}
+	dispatch := &TaskQueue{
+		entries: append([]*queueEntry{}, q.entries...),
+		served:  make(map[string]int),
+	}
+
+	for app, served := range q.served {
+		dispatch.served[app] = served
+	}
+
+	dispatch.dispatches = q.dispatches
+
+	for i := range q.entries {
+		entry := dispatch.pop(nil)
+
+		listed = append(listed, &QueuedTask{
+			BuildId:  entry.task.BuildId,
+			TaskId:   entry.task.Id,
+			App:      entry.app,
+			Priority: entry.priority,
+			Position: i + 1,
+		})
+	}
+
+	return listed
+}
+
+// Positions maps the ids of a build's queued tasks to their place in the
+// queue, counting from one.
+func (q *TaskQueue) Positions(buildId string) map[string]int {
+	positions := make(map[string]int)
+
+	for _, queued := range q.List() {
+		if queued.BuildId == buildId {
+			positions[queued.TaskId] = queued.Position
+		}
+	}
+
+	return positions
+}
+
+func (q *TaskQueue) pop(fits func(*Task) bool) *queueEntry {
+	i := q.next(fits)
+
+	if i < 0 {
+		return nil
+	}
+
+	entry := q.entries[i]
+
+	q.remove(entry)
+	q.dispatches++
+	q.served[entry.app] = q.dispatches
+
+	return entry
+}
+
+// next returns the index of the entry to dispatch next, or -1 if no entry
+// fits.
+func (q *TaskQueue) next(fits func(*Task) bool) int {
+	best := -1
+	seen := make(map[queueEntry]bool)
+
+	for i, entry := range q.entries {
+		if fits != nil && !fits(entry.task) {
+			continue
+		}
+
+		// Only the first entry of each app at each priority competes,
+		// keeping an app's tasks in order.
+		key := queueEntry{app: entry.app, priority: entry.priority}
+
+		if seen[key] {
+			continue
+		}
+
+		seen[key] = true
+
+		if best < 0 || entry.priority > q.entries[best].priority {
+			best = i
+
+			continue
+		}
+
+		if entry.priority == q.entries[best].priority && q.served[entry.app] < q.served[q.entries[best].app] {
+			best = i
+		}
+	}
+
+	return best
+}
+
+func (q *TaskQueue) remove(removed *queueEntry) {
+	for i, entry := range q.entries {
+		if entry == removed {
+			q.entries = append(q.entries[:i], q.entries[i+1:]...)
+
+			return
+		}
+	}
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+type queuedTask struct {
+	id       string
+	app      string
+	priority int
+}
+
+func TestTaskQueueOrder(t *testing.T) {
+	tests := []struct {
+		name   string
+		pushed []queuedTask
+		order  []string
+	}{
+		{
+			name:   "higher priority first",
+			pushed: []queuedTask{{"a1", "a", 0}, {"b1", "b", masterBranchPriority}},
+			order:  []string{"b1", "a1"},
+		},
+		{
+			name:   "app tasks in the order queued",
+			pushed: []queuedTask{{"a1", "a", 0}, {"a2", "a", 0}, {"a3", "a", 0}},
+			order:  []string{"a1", "a2", "a3"},
+		},
+		{
+			name:   "apps take turns",
+			pushed: []queuedTask{{"a1", "a", 0}, {"a2", "a", 0}, {"b1", "b", 0}, {"b2", "b", 0}},
+			order:  []string{"a1", "b1", "a2", "b2"},
+		},
+		{
+			name:   "app served least recently goes next",
+			pushed: []queuedTask{{"a1", "a", 0}, {"a2", "a", masterBranchPriority}, {"b1", "b", 0}},
+			order:  []string{"a2", "b1", "a1"},
+		},
+	}
+
+	for _, test := range tests {
+		q := NewTaskQueue()
+
+		for _, pushed := range test.pushed {
+			q.Push(&Task{
+				Id:      pushed.id,
+				BuildId: pushed.app,
+				Build:   &Build{Id: pushed.app, App: pushed.app, Priority: pushed.priority},
+			})
+		}
+
+		listed := []string{}
+
+		for _, queued := range q.List() {
+			listed = append(listed, queued.TaskId)
+		}
+
+		if !reflect.DeepEqual(listed, test.order) {
+			t.Errorf("%s: listed %v, want %v", test.name, listed, test.order)
+		}
+
+		popped := []string{}
+
+		for task := q.Pop(nil); task != nil; task = q.Pop(nil) {
+			popped = append(popped, task.Id)
+		}
+
+		if !reflect.DeepEqual(popped, test.order) {
+			t.Errorf("%s: popped %v, want %v", test.name, popped, test.order)
+		}
+	}
+}
+
+func TestTaskQueueRequeue(t *testing.T) {
+	q := NewTaskQueue()
+	build := &Build{Id: "a", App: "a"}
+
+	for _, id := range []string{"a1", "a2", "a3"} {
+		q.Push(&Task{Id: id, BuildId: build.Id, Build: build})
+	}
+
+	popped := q.Pop(nil)
+
+	q.Push(&Task{Id: "a4", BuildId: build.Id, Build: build})
+	q.Requeue(popped)
+
+	order := []string{}
+
+	for _, queued := range q.List() {
+		order = append(order, queued.TaskId)
+	}
+
+	want := []string{"a1", "a2", "a3", "a4"}
+
+	if !reflect.DeepEqual(order, want) {
+		t.Errorf("listed %v, want %v", order, want)
+	}
+}
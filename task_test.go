@@ -0,0 +1,95 @@
+package main
+
+import (
+	"testing"
+
+	mesos "github.com/mesos/mesos-go/mesosproto"
+)
+
+func TestTaskShouldRetry(t *testing.T) {
+	tests := []struct {
+		name          string
+		state         mesos.TaskState
+		reason        *mesos.TaskStatus_Reason
+		attempts      int
+		retryFailures bool
+		timedOut      bool
+		retry         bool
+	}{
+		{
+			name:     "lost",
+			state:    mesos.TaskState_TASK_LOST,
+			attempts: 1,
+			retry:    true,
+		},
+		{
+			name:     "failed as the slave was removed",
+			state:    mesos.TaskState_TASK_FAILED,
+			reason:   mesos.TaskStatus_REASON_SLAVE_REMOVED.Enum(),
+			attempts: 1,
+			retry:    true,
+		},
+		{
+			name:     "failed",
+			state:    mesos.TaskState_TASK_FAILED,
+			attempts: 1,
+			retry:    false,
+		},
+		{
+			name:          "failed retrying failures",
+			state:         mesos.TaskState_TASK_FAILED,
+			attempts:      1,
+			retryFailures: true,
+			retry:         true,
+		},
+		{
+			name:          "finished retrying failures",
+			state:         mesos.TaskState_TASK_FINISHED,
+			attempts:      1,
+			retryFailures: true,
+			retry:         false,
+		},
+		{
+			name:     "lost on the last attempt",
+			state:    mesos.TaskState_TASK_LOST,
+			attempts: 3,
+			retry:    false,
+		},
+		{
+			name:          "killed after timing out",
+			state:         mesos.TaskState_TASK_KILLED,
+			attempts:      1,
+			retryFailures: true,
+			timedOut:      true,
+			retry:         false,
+		},
+		{
+			name:     "running",
+			state:    mesos.TaskState_TASK_RUNNING,
+			attempts: 1,
+			retry:    false,
+		},
+	}
+
+	for _, test := range tests {
+		task := &Task{
+			Id:            "task",
+			MaxAttempts:   3,
+			RetryFailures: test.retryFailures,
+			TimedOut:      test.timedOut,
+		}
+
+		for i := 0; i < test.attempts; i++ {
+			task.NewAttempt()
+		}
+
+		task.Status = &mesos.TaskStatus{
+			State:  test.state.Enum(),
+			Reason: test.reason,
+		}
+
+		if task.ShouldRetry() != test.retry {
+			t.Errorf("%s: retried %v, want %v", test.name, !test.retry, test.retry)
+		}
+	}
+}